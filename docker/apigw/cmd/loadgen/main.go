@@ -0,0 +1,189 @@
+// Command loadgen generates synthetic load on a gateway as described by a
+// scenario file, see scenario, and reports the latencies and errors of
+// every operation.
+//
+//	loadgen -json report.json scenario.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fcracker79/k8s-experiment/docker/rest/apigw/traffic"
+)
+
+// How often the virtual users are adjusted to the stages.
+const rampInterval = 100 * time.Millisecond
+
+// result is the JSON report of a run.
+type result struct {
+	Scenario *scenario `json:"scenario"`
+	// Arrivals not sent because max_in_flight requests were in flight.
+	Dropped uint64           `json:"dropped"`
+	Summary *traffic.Summary `json:"summary"`
+}
+
+func main() {
+	target := flag.String("target", "", "base URL of the gateway, instead of the target of the scenario")
+	jsonReport := flag.String("json", "", "file the JSON report is written to")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] scenario\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	s, err := readScenario(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *target != "" {
+		s.Target = *target
+	}
+	if s.Target == "" {
+		log.Fatal("no target")
+	}
+	s.Target = strings.TrimSuffix(s.Target, "/")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	g := newGenerator(s)
+	log.Printf("Generating load on %s for %s, ids prefixed by %s", s.Target, s.duration(), s.IDPrefix)
+	var dropped uint64
+	if s.rate() {
+		dropped = g.runRate(ctx)
+	} else {
+		g.runUsers(ctx)
+	}
+	g.report.Stop()
+
+	g.report.Print(os.Stdout)
+	if dropped > 0 {
+		fmt.Printf("\n%d arrivals not sent, %d requests were in flight\n", dropped, s.MaxInFlight)
+	}
+	if *jsonReport != "" {
+		// The headers may hold credentials.
+		reported := *s
+		reported.Headers = nil
+		data, err := json.MarshalIndent(&result{Scenario: &reported, Dropped: dropped, Summary: g.report.Summary()}, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(*jsonReport, append(data, '\n'), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// runRate starts the operations at the rate of the stages, whatever the
+// latency of the previous ones, and returns the arrivals not sent.
+func (g *generator) runRate(ctx context.Context) uint64 {
+	inFlight := make(chan struct{}, g.scenario.MaxInFlight)
+	var dropped atomic.Uint64
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	start := time.Now()
+	last, arrivals := start, 0.0
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			return dropped.Load()
+		}
+		elapsed := now.Sub(start)
+		if elapsed >= g.scenario.duration() {
+			return dropped.Load()
+		}
+		arrivals += g.scenario.load(elapsed) * now.Sub(last).Seconds()
+		last = now
+		for ; arrivals >= 1; arrivals-- {
+			select {
+			case inFlight <- struct{}{}:
+			default:
+				dropped.Add(1)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-inFlight }()
+				operations[g.scenario.pick()](g, ctx)
+			}()
+		}
+	}
+}
+
+// runUsers runs the virtual users of the stages, each one running an
+// operation after the other with a think time in between.
+func (g *generator) runUsers(ctx context.Context) {
+	var users []chan struct{}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer func() {
+		for _, stop := range users {
+			close(stop)
+		}
+	}()
+
+	ticker := time.NewTicker(rampInterval)
+	defer ticker.Stop()
+	start := time.Now()
+	for now := start; now.Sub(start) < g.scenario.duration(); {
+		want := int(math.Round(g.scenario.load(now.Sub(start))))
+		for len(users) < want {
+			stop := make(chan struct{})
+			users = append(users, stop)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g.user(ctx, stop)
+			}()
+		}
+		for len(users) > want {
+			close(users[len(users)-1])
+			users = users[:len(users)-1]
+		}
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *generator) user(ctx context.Context, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+		operations[g.scenario.pick()](g, ctx)
+		select {
+		case <-time.After(g.scenario.think()):
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fcracker79/k8s-experiment/docker/rest/apigw/traffic"
+)
+
+// How often the asynchronously created users are looked for.
+const asyncPollInterval = 100 * time.Millisecond
+
+// operations are the operations a scenario mixes, by name. The ones on an
+// existing user or company create one instead while there is none.
+var operations = map[string]func(*generator, context.Context){
+	"create_user":       (*generator).createUser,
+	"get_user":          (*generator).getUser,
+	"delete_user":       (*generator).deleteUser,
+	"create_company":    (*generator).createCompany,
+	"get_company":       (*generator).getCompany,
+	"delete_company":    (*generator).deleteCompany,
+	"create_user_async": (*generator).createUserAsync,
+}
+
+// pool holds the ids of the resources created and not in use by an
+// operation, so that a get never races with the delete of the same id.
+type pool struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (p *pool) put(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ids = append(p.ids, id)
+}
+
+// take removes a random id from the pool.
+func (p *pool) take() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.ids) == 0 {
+		return "", false
+	}
+	i := rand.IntN(len(p.ids))
+	id := p.ids[i]
+	p.ids[i] = p.ids[len(p.ids)-1]
+	p.ids = p.ids[:len(p.ids)-1]
+	return id, true
+}
+
+// generator runs the operations of a scenario against the gateway.
+type generator struct {
+	scenario  *scenario
+	client    *http.Client
+	report    *traffic.Report
+	users     pool
+	companies pool
+	lastID    atomic.Uint64
+}
+
+func newGenerator(s *scenario) *generator {
+	return &generator{
+		scenario: s,
+		client:   &http.Client{Timeout: time.Duration(s.Timeout)},
+		report:   traffic.NewReport(),
+	}
+}
+
+func (g *generator) newID(kind string) string {
+	return fmt.Sprintf("%s-%s%d", g.scenario.IDPrefix, kind, g.lastID.Add(1))
+}
+
+// send sends a request and returns its response.
+func (g *generator) send(ctx context.Context, method, path string, body any) (int, []byte, error) {
+	var payload io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, g.scenario.Target+path, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	for name, value := range g.scenario.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if id, ok := body.(map[string]string); ok && method == http.MethodPost {
+		// Creating the same id twice is safe.
+		req.Header.Set("Idempotency-Key", id["id"])
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// do sends a request of an operation and checks that its status is one of
+// statuses and that, if id is set, it returns the resource with this id. It
+// returns whether the response is the expected one.
+func (g *generator) do(ctx context.Context, operation, method, path string, body any, statuses []int, id string) bool {
+	start := time.Now()
+	status, data, err := g.send(ctx, method, path, body)
+	latency := time.Since(start)
+	if err != nil && ctx.Err() != nil {
+		// Interrupted, not a failure of the gateway.
+		return false
+	}
+	if err == nil && status < 400 {
+		err = verify(status, data, statuses, id)
+	}
+	g.report.Add(operation, status, err, latency)
+	return err == nil && slices.Contains(statuses, status)
+}
+
+func verify(status int, data []byte, statuses []int, id string) error {
+	if !slices.Contains(statuses, status) {
+		return traffic.Failure(fmt.Sprintf("unexpected status %d", status))
+	}
+	if id == "" {
+		return nil
+	}
+	var resource struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &resource); err != nil {
+		return traffic.Failure("invalid JSON response")
+	}
+	if resource.ID != id {
+		return traffic.Failure("wrong id in the response")
+	}
+	return nil
+}
+
+func (g *generator) createUser(ctx context.Context) {
+	id := g.newID("user")
+	body := map[string]string{"id": id, "name": "Load test user " + id}
+	if g.do(ctx, "create_user", http.MethodPost, "/users", body, []int{http.StatusOK, http.StatusCreated}, id) {
+		g.users.put(id)
+	}
+}
+
+func (g *generator) getUser(ctx context.Context) {
+	id, ok := g.users.take()
+	if !ok {
+		g.createUser(ctx)
+		return
+	}
+	if g.do(ctx, "get_user", http.MethodGet, "/users/"+id, nil, []int{http.StatusOK}, id) {
+		g.users.put(id)
+	}
+}
+
+func (g *generator) deleteUser(ctx context.Context) {
+	id, ok := g.users.take()
+	if !ok {
+		g.createUser(ctx)
+		return
+	}
+	g.do(ctx, "delete_user", http.MethodDelete, "/users/"+id, nil, []int{http.StatusOK, http.StatusNoContent}, "")
+}
+
+func (g *generator) createCompany(ctx context.Context) {
+	id := g.newID("company")
+	body := map[string]string{"id": id, "name": "Load test company " + id}
+	if g.do(ctx, "create_company", http.MethodPost, "/companies", body, []int{http.StatusOK, http.StatusCreated}, id) {
+		g.companies.put(id)
+	}
+}
+
+func (g *generator) getCompany(ctx context.Context) {
+	id, ok := g.companies.take()
+	if !ok {
+		g.createCompany(ctx)
+		return
+	}
+	if g.do(ctx, "get_company", http.MethodGet, "/companies/"+id, nil, []int{http.StatusOK}, id) {
+		g.companies.put(id)
+	}
+}
+
+func (g *generator) deleteCompany(ctx context.Context) {
+	id, ok := g.companies.take()
+	if !ok {
+		g.createCompany(ctx)
+		return
+	}
+	g.do(ctx, "delete_company", http.MethodDelete, "/companies/"+id, nil, []int{http.StatusOK, http.StatusNoContent}, "")
+}
+
+// createUserAsync creates a user through NATS, then waits for the user
+// service to have it, reporting the time it took as "create_user_async
+// visible".
+func (g *generator) createUserAsync(ctx context.Context) {
+	start := time.Now()
+	id := g.newID("user")
+	body := map[string]string{"id": id, "name": "Load test user " + id}
+	if !g.do(ctx, "create_user_async", http.MethodPost, "/async/users", body, []int{http.StatusAccepted}, "") {
+		return
+	}
+	timeout := time.Duration(*g.scenario.AsyncTimeout)
+	if timeout == 0 {
+		return
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-time.After(asyncPollInterval):
+		case <-deadline.C:
+			g.report.Add("create_user_async visible", 0, traffic.Failure("not created in time"), time.Since(start))
+			return
+		case <-ctx.Done():
+			return
+		}
+		status, data, err := g.send(ctx, http.MethodGet, "/users/"+id, nil)
+		if err == nil && status == http.StatusOK && verify(status, data, []int{http.StatusOK}, id) == nil {
+			g.report.Add("create_user_async visible", status, nil, time.Since(start))
+			g.users.put(id)
+			return
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"time"
+)
+
+// scenario is the load to generate. ${VAR} in the file is replaced by the
+// environment variable VAR, e.g. to pass a token:
+//
+//	{
+//	  "target": "http://minikube.ingress",
+//	  "headers": {"Authorization": "Bearer ${TOKEN}"},
+//	  "mix": [
+//	    {"operation": "create_user", "weight": 2},
+//	    {"operation": "get_user", "weight": 10},
+//	    {"operation": "create_user_async", "weight": 1}
+//	  ],
+//	  "think_time": {"min": "100ms", "max": "1s"},
+//	  "stages": [
+//	    {"duration": "30s", "users": 50},
+//	    {"duration": "5m", "users": 50}
+//	  ]
+//	}
+type scenario struct {
+	// Base URL of the gateway, including the version prefix if any.
+	Target  string            `json:"target"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Prefix of the ids of the users and companies created, random by
+	// default.
+	IDPrefix string `json:"id_prefix"`
+	// Timeout of each request, 10s by default.
+	Timeout duration `json:"timeout"`
+	// Time the asynchronously created users are waited for, polling the
+	// gateway, 10s by default; "0s" does not wait for them.
+	AsyncTimeout *duration `json:"async_timeout"`
+	// Requests in flight beyond which the arrivals of the rate stages are
+	// not sent, 1000 by default.
+	MaxInFlight int                 `json:"max_in_flight"`
+	Mix         []weightedOperation `json:"mix"`
+	// Pause of the virtual users between their operations.
+	ThinkTime *thinkTime `json:"think_time,omitempty"`
+	Stages    []stage    `json:"stages"`
+}
+
+type weightedOperation struct {
+	Operation string `json:"operation"`
+	Weight    int    `json:"weight"`
+}
+
+type thinkTime struct {
+	Min duration `json:"min"`
+	Max duration `json:"max"`
+}
+
+// stage ramps the load linearly, from the one at the end of the previous
+// stage (none for the first) to Rate requests per second, or to Users
+// virtual users sending requests one after the other.
+type stage struct {
+	Duration duration `json:"duration"`
+	Rate     float64  `json:"rate,omitempty"`
+	Users    int      `json:"users,omitempty"`
+}
+
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func readScenario(path string) (*scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s scenario
+	if err := json.Unmarshal([]byte(os.ExpandEnv(string(data))), &s); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %w", path, err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// validate checks the scenario and fills in the defaults.
+func (s *scenario) validate() error {
+	if s.Timeout == 0 {
+		s.Timeout = duration(10 * time.Second)
+	}
+	if s.AsyncTimeout == nil {
+		s.AsyncTimeout = new(duration)
+		*s.AsyncTimeout = duration(10 * time.Second)
+	}
+	if s.MaxInFlight == 0 {
+		s.MaxInFlight = 1000
+	}
+	if s.IDPrefix == "" {
+		s.IDPrefix = fmt.Sprintf("load-%06x", rand.IntN(1<<24))
+	}
+	if s.Timeout < 0 || *s.AsyncTimeout < 0 || s.MaxInFlight < 0 {
+		return errors.New("timeout, async_timeout and max_in_flight cannot be negative")
+	}
+	if len(s.Mix) == 0 {
+		return errors.New("no operation in the mix")
+	}
+	for _, op := range s.Mix {
+		if _, exists := operations[op.Operation]; !exists {
+			return fmt.Errorf("unknown operation %q", op.Operation)
+		}
+		if op.Weight <= 0 {
+			return fmt.Errorf("operation %s: the weight must be positive", op.Operation)
+		}
+	}
+	if s.ThinkTime != nil && (s.ThinkTime.Min < 0 || s.ThinkTime.Max < s.ThinkTime.Min) {
+		return errors.New("think_time: min cannot be negative nor greater than max")
+	}
+	if len(s.Stages) == 0 {
+		return errors.New("no stage")
+	}
+	for i, st := range s.Stages {
+		if st.Duration <= 0 {
+			return fmt.Errorf("stage %d: the duration must be positive", i)
+		}
+		if st.Rate < 0 || st.Users < 0 {
+			return fmt.Errorf("stage %d: the load cannot be negative", i)
+		}
+		if st.Rate > 0 && st.Users > 0 {
+			return fmt.Errorf("stage %d: either rate or users", i)
+		}
+	}
+	if s.rate() && s.users() {
+		return errors.New("the stages either set a rate or users, not both")
+	}
+	return nil
+}
+
+// rate tells whether the stages set the arrival rate.
+func (s *scenario) rate() bool {
+	for _, st := range s.Stages {
+		if st.Rate > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// users tells whether the stages set the virtual users.
+func (s *scenario) users() bool {
+	for _, st := range s.Stages {
+		if st.Users > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scenario) duration() time.Duration {
+	var res time.Duration
+	for _, st := range s.Stages {
+		res += time.Duration(st.Duration)
+	}
+	return res
+}
+
+// load returns the rate or the virtual users at elapsed since the start.
+func (s *scenario) load(elapsed time.Duration) float64 {
+	var from float64
+	for _, st := range s.Stages {
+		to := st.Rate + float64(st.Users)
+		if elapsed < time.Duration(st.Duration) {
+			return from + (to-from)*float64(elapsed)/float64(st.Duration)
+		}
+		elapsed -= time.Duration(st.Duration)
+		from = to
+	}
+	return from
+}
+
+// pick returns an operation of the mix, by weight.
+func (s *scenario) pick() string {
+	var total int
+	for _, op := range s.Mix {
+		total += op.Weight
+	}
+	n := rand.IntN(total)
+	for _, op := range s.Mix {
+		if n < op.Weight {
+			return op.Operation
+		}
+		n -= op.Weight
+	}
+	panic("unreachable")
+}
+
+func (s *scenario) think() time.Duration {
+	if s.ThinkTime == nil {
+		return 0
+	}
+	return time.Duration(s.ThinkTime.Min) + rand.N(time.Duration(s.ThinkTime.Max-s.ThinkTime.Min)+1)
+}
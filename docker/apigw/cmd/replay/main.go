@@ -0,0 +1,343 @@
+// Command replay sends the requests of a gateway traffic recording, see
+// TRAFFIC_RECORD_FILE, to a gateway and reports their latencies and errors.
+//
+//	replay -target http://minikube.ingress -speed 2 -rewrite-ids traffic.rec
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fcracker79/k8s-experiment/docker/rest/apigw/traffic"
+)
+
+// headerFlags are repeated -header flags.
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	name, value, found := strings.Cut(value, ":")
+	if !found {
+		return fmt.Errorf("header %q is not Name: value", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	return nil
+}
+
+type options struct {
+	target      string
+	speed       float64
+	rps         float64
+	concurrency int
+	repeat      int
+	timeout     time.Duration
+	rewriteIDs  bool
+	idSuffix    string
+	header      headerFlags
+}
+
+func main() {
+	opts := options{header: make(headerFlags)}
+	flag.StringVar(&opts.target, "target", "http://minikube.ingress", "base URL of the gateway")
+	flag.Float64Var(&opts.speed, "speed", 1, "replay speed relative to the recording, e.g. 2 for twice as fast")
+	flag.Float64Var(&opts.rps, "rps", 0, "send the requests at this fixed rate instead of the recorded timing")
+	flag.IntVar(&opts.concurrency, "concurrency", 100, "maximum number of requests in flight")
+	flag.IntVar(&opts.repeat, "repeat", 1, "times the recording is replayed, 0 to replay it until interrupted")
+	flag.DurationVar(&opts.timeout, "timeout", 10*time.Second, "timeout of each request")
+	flag.BoolVar(&opts.rewriteIDs, "rewrite-ids", false, "suffix the ids of the recording and the idempotency keys, so that replays create new resources")
+	flag.StringVar(&opts.idSuffix, "id-suffix", "", "suffix of the rewritten ids, random by default")
+	flag.Var(opts.header, "header", "header sent with every request, e.g. \"Authorization: Bearer ...\", repeatable")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] recording\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || opts.speed <= 0 || opts.rps < 0 || opts.concurrency <= 0 || opts.repeat < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if opts.rewriteIDs && opts.idSuffix == "" {
+		var raw [3]byte
+		rand.Read(raw[:])
+		opts.idSuffix = hex.EncodeToString(raw[:])
+	}
+
+	records, err := readRecording(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Their bodies are cut, the gateway would reject them.
+	complete := slices.DeleteFunc(slices.Clone(records), func(record *traffic.Record) bool { return record.Truncated })
+	if skipped := len(records) - len(complete); skipped > 0 {
+		log.Printf("skipping %d requests whose body is cut in the recording", skipped)
+	}
+	records = complete
+	if len(records) == 0 {
+		log.Fatal("the recording has no requests")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report := traffic.NewReport()
+	replay(ctx, opts, records, report)
+	report.Stop()
+	report.Print(os.Stdout)
+}
+
+func readRecording(path string) ([]*traffic.Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := traffic.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var res []*traffic.Record
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return res, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		res = append(res, record)
+	}
+}
+
+// replay sends the records opts.repeat times, until ctx is done.
+func replay(ctx context.Context, opts options, records []*traffic.Record, report *traffic.Report) {
+	client := &http.Client{Timeout: opts.timeout}
+	var ids *idRewriter
+	if opts.rewriteIDs {
+		ids = newIDRewriter(records)
+	}
+	inFlight := make(chan struct{}, opts.concurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for iteration := 0; opts.repeat == 0 || iteration < opts.repeat; iteration++ {
+		suffix := opts.idSuffix
+		if opts.repeat != 1 {
+			suffix = fmt.Sprintf("%s-%d", opts.idSuffix, iteration)
+		}
+		start := time.Now()
+		for i, record := range records {
+			var at time.Duration
+			if opts.rps > 0 {
+				at = time.Duration(float64(i) / opts.rps * float64(time.Second))
+			} else {
+				at = time.Duration(float64(record.Offset-records[0].Offset) / opts.speed)
+			}
+			select {
+			case <-time.After(time.Until(start.Add(at))):
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case inFlight <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			req, err := newRequest(ctx, opts, ids, suffix, record)
+			if err != nil {
+				log.Printf("skipping %s %s: %v", record.Method, record.URI, err)
+				<-inFlight
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-inFlight }()
+				send(client, req, operation(record), report)
+			}()
+		}
+	}
+}
+
+func newRequest(ctx context.Context, opts options, ids *idRewriter, suffix string, record *traffic.Record) (*http.Request, error) {
+	uri, body := record.URI, record.Body
+	if ids != nil {
+		uri, body = ids.rewriteURI(record, suffix), ids.rewriteBody(body, suffix)
+	}
+	req, err := http.NewRequestWithContext(ctx, record.Method, strings.TrimSuffix(opts.target, "/")+uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range record.Header {
+		req.Header.Set(name, value)
+	}
+	if key := req.Header.Get("Idempotency-Key"); key != "" && ids != nil {
+		req.Header.Set("Idempotency-Key", key+"-"+suffix)
+	}
+	for name, values := range opts.header {
+		req.Header[name] = values
+	}
+	return req, nil
+}
+
+func send(client *http.Client, req *http.Request, operation string, report *traffic.Report) {
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		if req.Context().Err() != nil {
+			// Interrupted, not a failure of the gateway.
+			return
+		}
+		report.Add(operation, 0, err, time.Since(start))
+		return
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	report.Add(operation, resp.StatusCode, err, time.Since(start))
+}
+
+// operation names the route of a record, e.g. "GET /v1/users/{id}".
+func operation(record *traffic.Record) string {
+	if record.Route != "" {
+		return record.Method + " " + record.Route
+	}
+	path, _, _ := strings.Cut(record.URI, "?")
+	return record.Method + " " + path
+}
+
+// Body fields holding the ids of users and companies.
+var idFields = []string{"id", "company_id", "companyId"}
+
+// idRewriter suffixes the ids of a recording wherever they appear: in the
+// path parameters of the routes, in the query and in the JSON bodies.
+type idRewriter struct {
+	ids map[string]bool
+}
+
+// newIDRewriter learns the ids of a recording: the values of the route
+// parameters and of the id fields of the bodies.
+func newIDRewriter(records []*traffic.Record) *idRewriter {
+	r := &idRewriter{ids: make(map[string]bool)}
+	for _, record := range records {
+		for _, i := range paramSegments(record.Route) {
+			path, _, _ := strings.Cut(record.URI, "?")
+			if segments := strings.Split(path, "/"); i < len(segments) {
+				if id, err := url.PathUnescape(segments[i]); err == nil && id != "" {
+					r.ids[id] = true
+				}
+			}
+		}
+		var body any
+		if json.Unmarshal(record.Body, &body) == nil {
+			r.learnFields(body)
+		}
+	}
+	return r
+}
+
+// paramSegments returns the indexes of the path segments of a route pattern
+// that are parameters.
+func paramSegments(route string) []int {
+	var res []int
+	for i, segment := range strings.Split(route, "/") {
+		if strings.HasPrefix(segment, "{") {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+func (r *idRewriter) learnFields(value any) {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, v := range value {
+			if id, ok := v.(string); ok && id != "" && slices.Contains(idFields, key) {
+				r.ids[id] = true
+			}
+			r.learnFields(v)
+		}
+	case []any:
+		for _, v := range value {
+			r.learnFields(v)
+		}
+	}
+}
+
+func (r *idRewriter) rewriteURI(record *traffic.Record, suffix string) string {
+	path, query, hasQuery := strings.Cut(record.URI, "?")
+	segments := strings.Split(path, "/")
+	for _, i := range paramSegments(record.Route) {
+		if i >= len(segments) {
+			continue
+		}
+		if id, err := url.PathUnescape(segments[i]); err == nil && r.ids[id] {
+			segments[i] = url.PathEscape(id + "-" + suffix)
+		}
+	}
+	res := strings.Join(segments, "/")
+	if !hasQuery {
+		return res
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return res + "?" + query
+	}
+	for _, vs := range values {
+		for i, v := range vs {
+			if r.ids[v] {
+				vs[i] = v + "-" + suffix
+			}
+		}
+	}
+	return res + "?" + values.Encode()
+}
+
+// rewriteBody suffixes the ids in a JSON body, other bodies are sent as
+// recorded.
+func (r *idRewriter) rewriteBody(body []byte, suffix string) []byte {
+	var value any
+	if len(body) == 0 || json.Unmarshal(body, &value) != nil {
+		return body
+	}
+	res, err := json.Marshal(r.rewriteValue(value, suffix))
+	if err != nil {
+		return body
+	}
+	return res
+}
+
+func (r *idRewriter) rewriteValue(value any, suffix string) any {
+	switch value := value.(type) {
+	case string:
+		if r.ids[value] {
+			return value + "-" + suffix
+		}
+	case map[string]any:
+		for key, v := range value {
+			value[key] = r.rewriteValue(v, suffix)
+		}
+	case []any:
+		for i, v := range value {
+			value[i] = r.rewriteValue(v, suffix)
+		}
+	}
+	return value
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/fcracker79/k8s-experiment/docker/rest/apigw/proto/user"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Deadline of a whole composite request, all the upstream calls included.
+const aggregateTimeout = "AGGREGATE_TIMEOUT"
+
+const (
+	defaultAggregateTimeout = 2 * time.Second
+	// Members listed by ?expand=members; the response tells when there are
+	// more.
+	maxExpandedMembers = 100
+)
+
+var getAggregateTimeout = sync.OnceValues(func() (time.Duration, error) {
+	value, exists := os.LookupEnv(aggregateTimeout)
+	if !exists {
+		return defaultAggregateTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", aggregateTimeout, err)
+	}
+	return timeout, nil
+})
+
+// expansionError reports an expansion that could not be resolved. The rest
+// of the response is still served.
+type expansionError struct {
+	Expand string `json:"expand"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// expandable serves the request with expanded when it has an expand query
+// parameter, with plain otherwise.
+func expandable(plain, expanded http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("expand") {
+			expanded(w, r)
+			return
+		}
+		plain(w, r)
+	}
+}
+
+// parseExpand returns the comma separated expansions of the request, failing
+// on the ones not in allowed.
+func parseExpand(r *http.Request, allowed ...string) ([]string, error) {
+	var res []string
+	for _, value := range r.URL.Query()["expand"] {
+		for _, expand := range strings.Split(value, ",") {
+			expand = strings.TrimSpace(expand)
+			if expand == "" || slices.Contains(res, expand) {
+				continue
+			}
+			if !slices.Contains(allowed, expand) {
+				return nil, fmt.Errorf("cannot expand %q, expected one of %s", expand, strings.Join(allowed, ", "))
+			}
+			res = append(res, expand)
+		}
+	}
+	return res, nil
+}
+
+// hasScope tells whether the caller may see an expansion. Without a
+// principal authentication is disabled, or require would have rejected the
+// request.
+func hasScope(ctx context.Context, scope string) bool {
+	p, ok := principalFromContext(ctx)
+	return !ok || p.Scopes[scope]
+}
+
+// toJSONObject turns v into a map, so that expansions can be added to it.
+func toJSONObject(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var res map[string]interface{}
+	return res, json.Unmarshal(data, &res)
+}
+
+// fetchCompany returns the JSON of a company, or the status describing why
+// it could not be fetched.
+func fetchCompany(ctx context.Context, id string) (json.RawMessage, int, error) {
+	req, err := newHTTPRequest(ctx, http.MethodGet, fmt.Sprintf("%s/companies/%s", getCompanyHttpEndpoint(), id), nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	resp, err := getHTTPClient().Do(req)
+	if err != nil {
+		return nil, companyErrorStatus(err), err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, companyErrorStatus(err), err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, http.StatusNotFound, fmt.Errorf("company %s not found", id)
+	case resp.StatusCode != http.StatusOK:
+		return nil, http.StatusBadGateway, fmt.Errorf("company service replied %s", resp.Status)
+	}
+	return body, http.StatusOK, nil
+}
+
+func writeAggregate(w http.ResponseWriter, result map[string]interface{}, errs []expansionError) {
+	if len(errs) > 0 {
+		result["errors"] = errs
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// getUserExpanded serves GET /users/{id}?expand=company, embedding the
+// company of the user.
+func getUserExpanded(w http.ResponseWriter, r *http.Request) {
+	expand, err := parseExpand(r, "company")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout, _ := getAggregateTimeout()
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	logger := zerolog.Ctx(ctx)
+
+	connection, err := createGrpcConnection(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("did not connect")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer connection.Close()
+	user, err := pb.NewUserServiceClient(connection).GetUser(ctx, &pb.User{Id: chi.URLParam(r, "id")})
+	if err != nil {
+		logger.Error().Err(err).Msg("could not fetch user")
+		http.Error(w, err.Error(), grpcStatusToHTTP(err))
+		return
+	}
+	representation := representationFromContext(ctx)
+	result, err := toJSONObject(representation.user(user))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var errs []expansionError
+	if slices.Contains(expand, "company") {
+		switch {
+		case user.CompanyId == "":
+			result["company"] = nil
+		case !hasScope(ctx, scopeCompaniesRead):
+			errs = append(errs, expansionError{"company", http.StatusForbidden, "missing scope " + scopeCompaniesRead})
+		default:
+			company, status, err := fetchCompany(ctx, user.CompanyId)
+			if err == nil {
+				result["company"], err = representation.company(company)
+				status = http.StatusBadGateway
+			}
+			if err != nil {
+				logger.Warn().Err(err).Msg("could not expand company")
+				errs = append(errs, expansionError{"company", status, err.Error()})
+			}
+		}
+	}
+	writeAggregate(w, result, errs)
+}
+
+// getCompanyExpanded serves GET /companies/{id}?expand=members, fetching the
+// company and its members concurrently.
+func getCompanyExpanded(w http.ResponseWriter, r *http.Request) {
+	expand, err := parseExpand(r, "members")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout, _ := getAggregateTimeout()
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	logger := zerolog.Ctx(ctx)
+	id := chi.URLParam(r, "id")
+
+	var (
+		wg         sync.WaitGroup
+		members    *pb.ListUsersResponse
+		membersErr error
+	)
+	if slices.Contains(expand, "members") && hasScope(ctx, scopeUsersRead) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			connection, err := createGrpcConnection(ctx)
+			if err != nil {
+				membersErr = status.Error(codes.Internal, err.Error())
+				return
+			}
+			defer connection.Close()
+			members, membersErr = pb.NewUserServiceClient(connection).ListUsers(ctx, &pb.ListUsersRequest{
+				CompanyId: id,
+				PageSize:  maxExpandedMembers,
+			})
+		}()
+	}
+	company, companyStatus, companyErr := fetchCompany(ctx, id)
+	wg.Wait()
+
+	if companyErr != nil {
+		logger.Error().Err(companyErr).Msg("could not fetch company")
+		http.Error(w, companyErr.Error(), companyStatus)
+		return
+	}
+	representation := representationFromContext(ctx)
+	converted, err := representation.company(company)
+	var result map[string]interface{}
+	if err == nil {
+		result, err = toJSONObject(converted)
+	}
+	if err != nil {
+		http.Error(w, "company service replied with invalid JSON", http.StatusBadGateway)
+		return
+	}
+
+	var errs []expansionError
+	if slices.Contains(expand, "members") {
+		switch {
+		case !hasScope(ctx, scopeUsersRead):
+			errs = append(errs, expansionError{"members", http.StatusForbidden, "missing scope " + scopeUsersRead})
+		case membersErr != nil:
+			logger.Warn().Err(membersErr).Msg("could not expand members")
+			errs = append(errs, expansionError{"members", grpcStatusToHTTP(membersErr), membersErr.Error()})
+		default:
+			for key, value := range representation.members(members.Users, members.NextPageToken != "") {
+				result[key] = value
+			}
+		}
+	}
+	writeAggregate(w, result, errs)
+}
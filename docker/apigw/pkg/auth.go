@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// Path or http(s) URL of the JWKS used to verify bearer tokens. When not
+	// set authentication is disabled and every route is public.
+	authJWKS                = "AUTH_JWKS"
+	authJWKSRefreshInterval = "AUTH_JWKS_REFRESH_INTERVAL"
+	// Expected iss and aud claims, not checked when not set.
+	authIssuer   = "AUTH_ISSUER"
+	authAudience = "AUTH_AUDIENCE"
+	// Scopes granted by the roles claim, e.g.
+	// "admin=users:read users:write companies:read companies:write;support=users:read".
+	authRoleScopes = "AUTH_ROLE_SCOPES"
+
+	defaultJWKSRefreshInterval = 5 * time.Minute
+
+	// The verified subject is forwarded to the company service with this
+	// header and to the user service with this metadata key.
+	subjectHeader      = "X-Auth-Subject"
+	subjectMetadataKey = "x-auth-subject"
+)
+
+const (
+	scopeUsersRead      = "users:read"
+	scopeUsersWrite     = "users:write"
+	scopeCompaniesRead  = "companies:read"
+	scopeCompaniesWrite = "companies:write"
+)
+
+// principal is the verified identity behind a request.
+type principal struct {
+	Subject string
+	Scopes  map[string]bool
+}
+
+type principalKey struct{}
+
+func principalFromContext(ctx context.Context) (*principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*principal)
+	return p, ok
+}
+
+type authenticator struct {
+	keys       *jwks
+	parser     *jwt.Parser
+	roleScopes map[string][]string
+}
+
+// newAuthenticator loads the JWKS and keeps it fresh until ctx is done. It
+// returns nil when authentication is disabled.
+func newAuthenticator(ctx context.Context) (*authenticator, error) {
+	source, exists := os.LookupEnv(authJWKS)
+	if !exists {
+		log.Warn().Msgf("%s not set, authentication is disabled", authJWKS)
+		return nil, nil
+	}
+	interval := defaultJWKSRefreshInterval
+	if value, exists := os.LookupEnv(authJWKSRefreshInterval); exists {
+		var err error
+		if interval, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", authJWKSRefreshInterval, err)
+		}
+	}
+	roleScopes, err := parseRoleScopes(os.Getenv(authRoleScopes))
+	if err != nil {
+		return nil, err
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if issuer, exists := os.LookupEnv(authIssuer); exists {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+	if audience, exists := os.LookupEnv(authAudience); exists {
+		options = append(options, jwt.WithAudience(audience))
+	}
+
+	keys := newJWKS(source)
+	if err := keys.refresh(ctx); err != nil {
+		return nil, err
+	}
+	go keys.run(ctx, interval)
+	return &authenticator{
+		keys:       keys,
+		parser:     jwt.NewParser(options...),
+		roleScopes: roleScopes,
+	}, nil
+}
+
+func parseRoleScopes(value string) (map[string][]string, error) {
+	res := make(map[string][]string)
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		role, scopes, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("%s: invalid entry %q", authRoleScopes, entry)
+		}
+		res[strings.TrimSpace(role)] = strings.Fields(scopes)
+	}
+	return res, nil
+}
+
+// scopes collects the scopes granted by the scope (space separated, as in
+// OAuth 2), scp (string or list) and roles claims.
+func (a *authenticator) scopes(claims jwt.MapClaims) map[string]bool {
+	res := make(map[string]bool)
+	add := func(claim interface{}, mapped map[string][]string) {
+		var values []string
+		switch claim := claim.(type) {
+		case string:
+			values = strings.Fields(claim)
+		case []interface{}:
+			for _, value := range claim {
+				if value, ok := value.(string); ok {
+					values = append(values, value)
+				}
+			}
+		}
+		for _, value := range values {
+			if mapped == nil {
+				res[value] = true
+				continue
+			}
+			for _, scope := range mapped[value] {
+				res[scope] = true
+			}
+		}
+	}
+	add(claims["scope"], nil)
+	add(claims["scp"], nil)
+	add(claims["roles"], a.roleScopes)
+	return res
+}
+
+func unauthorized(w http.ResponseWriter, description string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, description))
+	http.Error(w, description, http.StatusUnauthorized)
+}
+
+// Middleware verifies the bearer token of the request, if any, and stores
+// the resulting principal in the request context. Whether a token is needed
+// at all is up to the routes, see require.
+func (a *authenticator) Middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scheme, rawToken, found := strings.Cut(header, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			unauthorized(w, "expected a bearer token")
+			return
+		}
+		claims := jwt.MapClaims{}
+		if _, err := a.parser.ParseWithClaims(strings.TrimSpace(rawToken), claims, a.keys.keyfunc(r.Context())); err != nil {
+			zerolog.Ctx(r.Context()).Info().Err(err).Msg("rejected bearer token")
+			unauthorized(w, "invalid bearer token")
+			return
+		}
+		subject, _ := claims.GetSubject()
+		if subject == "" {
+			unauthorized(w, "token has no subject")
+			return
+		}
+		p := &principal{Subject: subject, Scopes: a.scopes(claims)}
+		ctx := context.WithValue(r.Context(), principalKey{}, p)
+		logger := zerolog.Ctx(ctx).With().Str("subject", subject).Logger()
+		next.ServeHTTP(w, r.WithContext(logger.WithContext(ctx)))
+	})
+}
+
+// require rejects requests without a principal holding all the given
+// scopes. It lets everything through when authentication is disabled.
+func (a *authenticator) require(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if a == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := principalFromContext(r.Context())
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+				return
+			}
+			for _, scope := range scopes {
+				if !p.Scopes[scope] {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(scopes, " ")))
+					http.Error(w, fmt.Sprintf("missing scope %s", scope), http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allows tells whether the principal of ctx holds scope, for handlers that
+// authorize parts of a request rather than the whole route.
+func (a *authenticator) allows(ctx context.Context, scope string) bool {
+	if a == nil {
+		return true
+	}
+	p, ok := principalFromContext(ctx)
+	return ok && p.Scopes[scope]
+}
+
+func withSubjectMetadata(ctx context.Context) context.Context {
+	if p, ok := principalFromContext(ctx); ok {
+		return metadata.AppendToOutgoingContext(ctx, subjectMetadataKey, p.Subject)
+	}
+	return ctx
+}
+
+// subjectUnaryClientInterceptor forwards the verified subject to the user
+// service.
+func subjectUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(withSubjectMetadata(ctx), method, req, reply, cc, opts...)
+}
+
+func subjectStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(withSubjectMetadata(ctx), desc, cc, method, opts...)
+}
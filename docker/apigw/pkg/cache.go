@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// How long GET /users/{id} and GET /companies/{id} responses are cached.
+	// When not set the corresponding cache is disabled.
+	cacheUserTTL    = "CACHE_USER_TTL"
+	cacheCompanyTTL = "CACHE_COMPANY_TTL"
+	// Maximum number of responses kept by each cache.
+	cacheMaxEntries = "CACHE_MAX_ENTRIES"
+	// Subject prefixes of the change events published by the user and the
+	// company services, used to drop stale entries.
+	natsUserEventsSubject    = "NATS_USER_EVENTS_SUBJECT"
+	natsCompanyEventsSubject = "NATS_COMPANY_EVENTS_SUBJECT"
+
+	defaultCacheMaxEntries = 10000
+	// Invalidations are remembered this long, so that a response fetched
+	// before an invalidation is not stored after it. It must be longer than
+	// any upstream call.
+	cacheInvalidationMemory = time.Minute
+	// Upper bound of the upstream call filling the cache, which does not
+	// end with the request that runs it.
+	cacheFetchTimeout = 30 * time.Second
+)
+
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// cacheKey identifies a cached response: the versions of a route with the
+// same representation share their entries, the targets of an upstream group
+// do not.
+type cacheKey struct {
+	id             string
+	representation representation
+	target         string
+}
+
+// Response headers that belong to the request filling the cache and are
+// not served to the others.
+var uncachedHeaders = []string{"Set-Cookie", upstreamTargetHeader}
+
+// responseCache caches the successful responses of a route keyed by its id
+// parameter.
+type responseCache struct {
+	name       string
+	ttl        time.Duration
+	maxEntries int
+	group      singleflight.Group
+
+	mu          sync.Mutex
+	entries     map[cacheKey]*cachedResponse
+	invalidated map[string]time.Time
+}
+
+type responseCaches struct {
+	users     *responseCache
+	companies *responseCache
+}
+
+// newResponseCaches creates the caches enabled by CACHE_USER_TTL and
+// CACHE_COMPANY_TTL and subscribes them to the change events.
+func newResponseCaches() (*responseCaches, error) {
+	maxEntries := defaultCacheMaxEntries
+	if value, exists := os.LookupEnv(cacheMaxEntries); exists {
+		var err error
+		if maxEntries, err = strconv.Atoi(value); err != nil || maxEntries <= 0 {
+			return nil, fmt.Errorf("invalid %s: %q", cacheMaxEntries, value)
+		}
+	}
+
+	caches := &responseCaches{}
+	var conn *nats.Conn
+	for _, c := range []struct {
+		cache      **responseCache
+		name       string
+		ttlEnv     string
+		subjectEnv string
+	}{
+		{&caches.users, "users", cacheUserTTL, natsUserEventsSubject},
+		{&caches.companies, "companies", cacheCompanyTTL, natsCompanyEventsSubject},
+	} {
+		value, exists := os.LookupEnv(c.ttlEnv)
+		if !exists {
+			continue
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", c.ttlEnv, err)
+		}
+		cache := newResponseCache(c.name, ttl, maxEntries)
+		*c.cache = cache
+
+		subject, exists := os.LookupEnv(c.subjectEnv)
+		if !exists {
+			log.Warn().Msgf("%s not set, cached %s are only refreshed when they expire", c.subjectEnv, c.name)
+			continue
+		}
+		if conn == nil {
+			if conn, err = createNATSConnection(); err != nil {
+				return nil, fmt.Errorf("could not create NATS connection: %w", err)
+			}
+		}
+		if _, err := conn.Subscribe(subject+".>", cache.onEvent); err != nil {
+			return nil, fmt.Errorf("could not subscribe to %s: %w", subject, err)
+		}
+	}
+	return caches, nil
+}
+
+func newResponseCache(name string, ttl time.Duration, maxEntries int) *responseCache {
+	c := &responseCache{
+		name:        name,
+		ttl:         ttl,
+		maxEntries:  maxEntries,
+		entries:     make(map[cacheKey]*cachedResponse),
+		invalidated: make(map[string]time.Time),
+	}
+	go c.purge()
+	return c
+}
+
+// onEvent drops the entry of the user or company named by a change event.
+func (c *responseCache) onEvent(msg *nats.Msg) {
+	var event struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(msg.Data, &event); err != nil || event.ID == "" {
+		log.Warn().Err(err).Msgf("ignoring malformed event on %s", msg.Subject)
+		return
+	}
+	c.invalidate(event.ID)
+}
+
+func (c *responseCache) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if key.id == id {
+			delete(c.entries, key)
+		}
+	}
+	c.invalidated[id] = time.Now()
+	cacheInvalidations.WithLabelValues(c.name).Inc()
+	cacheEntries.WithLabelValues(c.name).Set(float64(len(c.entries)))
+}
+
+func (c *responseCache) get(key cacheKey) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+// store keeps entry unless its id was invalidated since fetchedAt.
+func (c *responseCache) store(key cacheKey, entry *cachedResponse, fetchedAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if invalidatedAt, ok := c.invalidated[key.id]; ok && !invalidatedAt.Before(fetchedAt) {
+		return
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		c.evictExpired(time.Now())
+		if len(c.entries) >= c.maxEntries {
+			// Make room by dropping any entry, map order is random enough.
+			for victim := range c.entries {
+				delete(c.entries, victim)
+				break
+			}
+		}
+	}
+	c.entries[key] = entry
+	cacheEntries.WithLabelValues(c.name).Set(float64(len(c.entries)))
+}
+
+func (c *responseCache) evictExpired(now time.Time) {
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key, invalidatedAt := range c.invalidated {
+		if now.Sub(invalidatedAt) > cacheInvalidationMemory {
+			delete(c.invalidated, key)
+		}
+	}
+}
+
+func (c *responseCache) purge() {
+	for now := range time.Tick(cacheInvalidationMemory) {
+		c.mu.Lock()
+		c.evictExpired(now)
+		cacheEntries.WithLabelValues(c.name).Set(float64(len(c.entries)))
+		c.mu.Unlock()
+	}
+}
+
+// responseRecorder buffers the response of the handler filling the cache.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(data)
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func computeETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches implements the weak comparison of If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *responseCache) write(w http.ResponseWriter, r *http.Request, entry *cachedResponse, result string) {
+	for name, values := range entry.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set("X-Cache", result)
+	if entry.etag != "" {
+		w.Header().Set("ETag", entry.etag)
+		// Clients may keep the response but have to revalidate it, since
+		// it can be invalidated at any time.
+		w.Header().Set("Cache-Control", "no-cache")
+		if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, entry.etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// Middleware serves the route from the cache, filling it on misses.
+// Concurrent misses for the same id are coalesced into a single upstream
+// call. Requests with a query, such as expansions, requests for another
+// representation than JSON and requests for a canary target through
+// X-Canary bypass the cache.
+func (c *responseCache) Middleware(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "" || !prefersJSON(r) || r.Header.Get(canaryHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := cacheKey{id: chi.URLParam(r, "id"), representation: representationFromContext(r.Context())}
+		if a := targetAssignmentFromContext(r.Context()); a != nil {
+			key.target = a.target.Name
+		}
+		if entry := c.get(key); entry != nil {
+			cacheRequests.WithLabelValues(c.name, "hit").Inc()
+			c.write(w, r, entry, "HIT")
+			return
+		}
+		leader := false
+		value, _, _ := c.group.Do(fmt.Sprintf("%T %s %s", key.representation, key.target, key.id), func() (interface{}, error) {
+			leader = true
+			fetchedAt := time.Now()
+			// The response goes to all the coalesced requests, so the call
+			// is not cancelled when the client running it goes away.
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), cacheFetchTimeout)
+			defer cancel()
+			recorder := &responseRecorder{header: make(http.Header)}
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			for _, name := range uncachedHeaders {
+				recorder.header.Del(name)
+			}
+			entry := &cachedResponse{
+				status:  recorder.status,
+				header:  recorder.header,
+				body:    recorder.body.Bytes(),
+				expires: fetchedAt.Add(c.ttl),
+			}
+			if entry.status == http.StatusOK {
+				entry.etag = computeETag(entry.body)
+				c.store(key, entry, fetchedAt)
+			}
+			return entry, nil
+		})
+		if leader {
+			cacheRequests.WithLabelValues(c.name, "miss").Inc()
+		} else {
+			cacheRequests.WithLabelValues(c.name, "coalesced").Inc()
+		}
+		c.write(w, r, value.(*cachedResponse), "MISS")
+	})
+}
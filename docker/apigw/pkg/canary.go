@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	// Request header naming the target of the upstream group that has to
+	// serve the request, whatever its weight.
+	canaryHeader = "X-Canary"
+	// Response header naming the target that served the request.
+	upstreamTargetHeader = "X-Upstream-Target"
+)
+
+const (
+	stickyBySubject = "subject"
+	stickyByHeader  = "header"
+	stickyByCookie  = "cookie"
+)
+
+// groupTarget is a deployment of an upstream group.
+type groupTarget struct {
+	Name string `json:"name"`
+	// Base URL of a REST upstream or address of the user service, ${VAR}
+	// is replaced by the environment variable VAR on each call.
+	Target string `json:"target"`
+	// Share of the traffic, relative to the other targets. Targets with no
+	// weight are only reached through X-Canary.
+	Weight int `json:"weight"`
+}
+
+// stickyPolicy keeps the requests of a client on the same target.
+type stickyPolicy struct {
+	// subject, header or cookie.
+	By string `json:"by"`
+	// Name of the header or of the cookie.
+	Name string `json:"name"`
+}
+
+// upstreamGroup splits the traffic of the routes calling it between its
+// targets, e.g. a stable and a canary deployment.
+type upstreamGroup struct {
+	Targets []*groupTarget `json:"targets"`
+	// Requests are spread at random when not sticky.
+	Sticky *stickyPolicy `json:"sticky"`
+
+	name        string
+	totalWeight int
+}
+
+func (g *upstreamGroup) validate() error {
+	if len(g.Targets) == 0 {
+		return fmt.Errorf("no targets")
+	}
+	seen := make(map[string]bool)
+	g.totalWeight = 0
+	for _, t := range g.Targets {
+		if t.Name == "" || t.Target == "" {
+			return fmt.Errorf("targets need a name and a target")
+		}
+		if err := checkTarget(t.Target); err != nil {
+			return fmt.Errorf("target %s: %w", t.Name, err)
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("target %s is defined twice", t.Name)
+		}
+		seen[t.Name] = true
+		if t.Weight < 0 {
+			return fmt.Errorf("target %s: weight must not be negative", t.Name)
+		}
+		g.totalWeight += t.Weight
+	}
+	if g.totalWeight == 0 {
+		return fmt.Errorf("no target has a weight")
+	}
+	if g.Sticky != nil {
+		switch g.Sticky.By {
+		case stickyBySubject:
+		case stickyByHeader, stickyByCookie:
+			if g.Sticky.Name == "" {
+				return fmt.Errorf("sticky %s needs a name", g.Sticky.By)
+			}
+		default:
+			return fmt.Errorf("unknown sticky policy %q", g.Sticky.By)
+		}
+	}
+	return nil
+}
+
+func (g *upstreamGroup) target(name string) *groupTarget {
+	for _, t := range g.Targets {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// bucket returns the target owning the nth unit of weight.
+func (g *upstreamGroup) bucket(n int) *groupTarget {
+	for _, t := range g.Targets {
+		if n < t.Weight {
+			return t
+		}
+		n -= t.Weight
+	}
+	return g.Targets[len(g.Targets)-1]
+}
+
+// hashBucket sticks a key to a target for as long as the weights do not
+// change.
+func (g *upstreamGroup) hashBucket(key string) *groupTarget {
+	h := fnv.New64a()
+	h.Write([]byte(g.name))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return g.bucket(int(h.Sum64() % uint64(g.totalWeight)))
+}
+
+// pick chooses the target of a request: the one named by X-Canary, then
+// the sticky one, then a random one by weight.
+func (g *upstreamGroup) pick(w http.ResponseWriter, r *http.Request) *groupTarget {
+	if t := g.target(r.Header.Get(canaryHeader)); t != nil {
+		return t
+	}
+	if g.Sticky == nil {
+		return g.bucket(rand.IntN(g.totalWeight))
+	}
+	switch g.Sticky.By {
+	case stickyBySubject:
+		if p, ok := principalFromContext(r.Context()); ok && p.Subject != "" {
+			return g.hashBucket(p.Subject)
+		}
+	case stickyByHeader:
+		if key := r.Header.Get(g.Sticky.Name); key != "" {
+			return g.hashBucket(key)
+		}
+	case stickyByCookie:
+		// Targets taken out of rotation give their clients away.
+		if cookie, err := r.Cookie(g.Sticky.Name); err == nil {
+			if t := g.target(cookie.Value); t != nil && t.Weight > 0 {
+				return t
+			}
+		}
+		t := g.bucket(rand.IntN(g.totalWeight))
+		http.SetCookie(w, &http.Cookie{
+			Name:     g.Sticky.Name,
+			Value:    t.Name,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return t
+	}
+	return g.bucket(rand.IntN(g.totalWeight))
+}
+
+// targetAssignment is the target of the upstream group serving a request.
+type targetAssignment struct {
+	group  string
+	kind   string
+	target *groupTarget
+	// Resilience policy of the target, nil for REST routes without an
+	// upstream name.
+	upstream *upstream
+}
+
+type targetAssignmentKey struct{}
+
+func targetAssignmentFromContext(ctx context.Context) *targetAssignment {
+	a, _ := ctx.Value(targetAssignmentKey{}).(*targetAssignment)
+	return a
+}
+
+// targetUpstreams keeps the circuit breakers and bulkheads of the targets
+// across route reloads, so that a failing canary does not open the circuit
+// of the stable target.
+var targetUpstreams sync.Map
+
+// targetUpstream returns the upstream of a target, with the policy of the
+// upstream it is a deployment of.
+func targetUpstream(group, target string, base *upstream) *upstream {
+	if base == nil {
+		return nil
+	}
+	name := base.name + "/" + group + "/" + target
+	if u, ok := targetUpstreams.Load(name); ok {
+		return u.(*upstream)
+	}
+	u, _ := targetUpstreams.LoadOrStore(name, newUpstream(name, base.policy, base.isFailure))
+	return u.(*upstream)
+}
+
+// Middleware assigns a target to the requests of a route calling the group
+// and counts their responses by target.
+func (g *upstreamGroup) Middleware(kind string, base *upstream) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t := g.pick(w, r)
+			a := &targetAssignment{
+				group:    g.name,
+				kind:     kind,
+				target:   t,
+				upstream: targetUpstream(g.name, t.Name, base),
+			}
+			w.Header().Set(upstreamTargetHeader, t.Name)
+
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), targetAssignmentKey{}, a)))
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			upstreamTargetRequests.WithLabelValues(g.name, t.Name, strconv.Itoa(status)).Inc()
+			upstreamTargetDuration.WithLabelValues(g.name, t.Name).Observe(time.Since(start).Seconds())
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// resettableWriter is a compressor that can be reused for another response.
+type resettableWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressors pool the writers of the supported content codings.
+var compressors = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		return gzip.NewWriter(io.Discard)
+	}},
+	"zstd": {New: func() any {
+		encoder, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return encoder
+	}},
+}
+
+// compressible tells whether responses of contentType are worth compressing.
+// Event streams are left alone, their clients expect every event as soon as
+// it is flushed.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"), strings.HasSuffix(mediaType, "json"),
+		mediaType == contentTypeNDJSON, mediaType == contentTypeProtobuf:
+		return true
+	}
+	return false
+}
+
+// compressWriter buffers the start of a response until it knows whether to
+// compress it: responses shorter than minSize, already encoded or not
+// compressible are sent as they are.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	decided bool
+	writer  resettableWriter
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status != 0 {
+		return
+	}
+	if status < http.StatusOK {
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+	c.status = status
+}
+
+func (c *compressWriter) Write(data []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.decided {
+		if c.writer != nil {
+			return c.writer.Write(data)
+		}
+		return c.ResponseWriter.Write(data)
+	}
+	c.buf = append(c.buf, data...)
+	if len(c.buf) >= c.minSize {
+		if err := c.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// decide sends the headers, compressing the response if large says it is
+// worth it, and then the buffered data.
+func (c *compressWriter) decide(large bool) error {
+	c.decided = true
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	header := c.Header()
+	if large && c.status != http.StatusNoContent && c.status != http.StatusNotModified &&
+		header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", c.encoding)
+		header.Del("Content-Length")
+		// The compressed representation is not byte for byte the one the
+		// strong validator names.
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		c.writer = compressors[c.encoding].Get().(resettableWriter)
+		c.writer.Reset(c.ResponseWriter)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	if len(c.buf) == 0 {
+		return nil
+	}
+	var err error
+	if c.writer != nil {
+		_, err = c.writer.Write(c.buf)
+	} else {
+		_, err = c.ResponseWriter.Write(c.buf)
+	}
+	c.buf = nil
+	return err
+}
+
+// Flush sends what was written so far, compressed if the response is
+// compressible at all: streaming responses are worth it whatever their
+// size.
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.decide(true)
+	}
+	if c.writer != nil {
+		c.writer.Flush()
+	}
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *compressWriter) close() {
+	if !c.decided {
+		if c.status == 0 && len(c.buf) == 0 {
+			// Nothing was written, let the server reply as usual.
+			return
+		}
+		c.decide(len(c.buf) >= c.minSize)
+	}
+	if c.writer != nil {
+		c.writer.Close()
+		compressors[c.encoding].Put(c.writer)
+		c.writer = nil
+	}
+}
+
+// Compress compresses the responses with the encoding preferred by the
+// client among the configured ones.
+func (p *httpPolicy) Compress(next http.Handler) http.Handler {
+	if p == nil || len(p.encodings) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiate(r.Header.Get("Accept-Encoding"), p.encodings, codingSpecificity)
+		// WebSockets take over the connection, which has to stay as it is.
+		if encoding == "" || r.Header.Get("Accept-Encoding") == "" || r.Method == http.MethodHead ||
+			strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: p.compressSize}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	pb "github.com/fcracker79/k8s-experiment/docker/rest/apigw/proto/user"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Upstream calls a loader runs concurrently.
+	loaderParallelism = 10
+	// Above this many companies a batch is fetched with a single
+	// GET /companies instead of one call per company.
+	companyListThreshold = 10
+)
+
+type loaderResult[V any] struct {
+	value V
+	err   error
+}
+
+// batchLoader fetches the values requested while resolving one level of a
+// GraphQL query together. Resolvers call load and return its thunk; the
+// executor calls the thunks once the whole level is resolved, and the first
+// one fetches every key collected so far. Values are cached for the rest of
+// the request.
+type batchLoader[K comparable, V any] struct {
+	fetch func(ctx context.Context, keys []K) map[K]loaderResult[V]
+
+	mu      sync.Mutex
+	pending []K
+	results map[K]loaderResult[V]
+}
+
+func newBatchLoader[K comparable, V any](fetch func(ctx context.Context, keys []K) map[K]loaderResult[V]) *batchLoader[K, V] {
+	return &batchLoader[K, V]{fetch: fetch, results: make(map[K]loaderResult[V])}
+}
+
+func (l *batchLoader[K, V]) load(ctx context.Context, key K) func() (V, error) {
+	l.mu.Lock()
+	if _, ok := l.results[key]; !ok {
+		l.pending = append(l.pending, key)
+	}
+	l.mu.Unlock()
+	return func() (V, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, ok := l.results[key]; !ok {
+			l.dispatch(ctx)
+		}
+		result := l.results[key]
+		return result.value, result.err
+	}
+}
+
+// dispatch fetches the pending keys. It is called with mu held.
+func (l *batchLoader[K, V]) dispatch(ctx context.Context) {
+	keys := make([]K, 0, len(l.pending))
+	seen := make(map[K]bool, len(l.pending))
+	for _, key := range l.pending {
+		if _, ok := l.results[key]; !ok && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	l.pending = nil
+	results := l.fetch(ctx, keys)
+	for _, key := range keys {
+		result, ok := results[key]
+		if !ok {
+			result.err = fmt.Errorf("no result for %v", key)
+		}
+		l.results[key] = result
+	}
+}
+
+// fetchEach runs fetch for every key, at most loaderParallelism at a time.
+func fetchEach[K comparable, V any](ctx context.Context, keys []K, fetch func(ctx context.Context, key K) (V, error)) map[K]loaderResult[V] {
+	var mu sync.Mutex
+	results := make(map[K]loaderResult[V], len(keys))
+	var g errgroup.Group
+	g.SetLimit(loaderParallelism)
+	for _, key := range keys {
+		g.Go(func() error {
+			value, err := fetch(ctx, key)
+			mu.Lock()
+			results[key] = loaderResult[V]{value, err}
+			mu.Unlock()
+			return nil
+		})
+	}
+	g.Wait()
+	return results
+}
+
+type membersKey struct {
+	companyID string
+	first     int32
+}
+
+// loaders batch and cache the upstream calls of a single GraphQL request.
+type loaders struct {
+	conn func() (*grpc.ClientConn, error)
+
+	users     *batchLoader[string, *pb.User]
+	companies *batchLoader[string, *Company]
+	members   *batchLoader[membersKey, []*pb.User]
+}
+
+func newLoaders(ctx context.Context) *loaders {
+	l := &loaders{conn: sync.OnceValues(func() (*grpc.ClientConn, error) {
+		return createGrpcConnection(ctx)
+	})}
+	l.users = newBatchLoader(func(ctx context.Context, ids []string) map[string]loaderResult[*pb.User] {
+		return fetchEach(ctx, ids, l.fetchUser)
+	})
+	l.companies = newBatchLoader(l.fetchCompanies)
+	l.members = newBatchLoader(func(ctx context.Context, keys []membersKey) map[membersKey]loaderResult[[]*pb.User] {
+		return fetchEach(ctx, keys, l.fetchMembers)
+	})
+	return l
+}
+
+func (l *loaders) client() (pb.UserServiceClient, error) {
+	conn, err := l.conn()
+	if err != nil {
+		return nil, err
+	}
+	return pb.NewUserServiceClient(conn), nil
+}
+
+// close releases the connection to the user service.
+func (l *loaders) close() {
+	if conn, err := l.conn(); err == nil {
+		conn.Close()
+	}
+}
+
+// fetchUser returns nil for missing users.
+func (l *loaders) fetchUser(ctx context.Context, id string) (*pb.User, error) {
+	c, err := l.client()
+	if err != nil {
+		return nil, err
+	}
+	user, err := c.GetUser(ctx, &pb.User{Id: id})
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	return user, err
+}
+
+func (l *loaders) fetchMembers(ctx context.Context, key membersKey) ([]*pb.User, error) {
+	c, err := l.client()
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.ListUsers(ctx, &pb.ListUsersRequest{CompanyId: key.companyID, PageSize: key.first})
+	if err != nil {
+		return nil, err
+	}
+	return response.Users, nil
+}
+
+// fetchCompanies returns nil for missing companies.
+func (l *loaders) fetchCompanies(ctx context.Context, ids []string) map[string]loaderResult[*Company] {
+	if len(ids) <= companyListThreshold {
+		return fetchEach(ctx, ids, func(ctx context.Context, id string) (*Company, error) {
+			data, code, err := fetchCompany(ctx, id)
+			if code == http.StatusNotFound {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			var company Company
+			if err := json.Unmarshal(data, &company); err != nil {
+				return nil, fmt.Errorf("company service replied with invalid JSON: %w", err)
+			}
+			return &company, nil
+		})
+	}
+
+	results := make(map[string]loaderResult[*Company], len(ids))
+	companies, err := fetchAllCompanies(ctx)
+	for _, id := range ids {
+		results[id] = loaderResult[*Company]{nil, err}
+	}
+	for _, company := range companies {
+		if _, ok := results[company.ID]; ok {
+			results[company.ID] = loaderResult[*Company]{company, nil}
+		}
+	}
+	return results
+}
+
+// fetchAllCompanies returns every company known to the company service.
+func fetchAllCompanies(ctx context.Context) ([]*Company, error) {
+	req, err := newHTTPRequest(ctx, http.MethodGet, fmt.Sprintf("%s/companies", getCompanyHttpEndpoint()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := getHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("company service replied %s", resp.Status)
+	}
+	var companies []*Company
+	if err := json.NewDecoder(resp.Body).Decode(&companies); err != nil {
+		return nil, fmt.Errorf("company service replied with invalid JSON: %w", err)
+	}
+	return companies, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// How long an event stream may stay idle before a heartbeat is sent, so
+	// that proxies keep it open and dead clients are noticed.
+	eventsHeartbeatInterval = "EVENTS_HEARTBEAT_INTERVAL"
+	// Clients not taking an event within this long are disconnected, they
+	// can resume from the last event they received.
+	eventsWriteTimeout = "EVENTS_WRITE_TIMEOUT"
+	// Comma separated origins allowed to open a WebSocket, * for any. When
+	// not set only same origin WebSockets are accepted.
+	eventsAllowedOrigins = "EVENTS_ALLOWED_ORIGINS"
+
+	defaultEventsHeartbeatInterval = 15 * time.Second
+	defaultEventsWriteTimeout      = 10 * time.Second
+	// Messages buffered for each client. Past this the consumer drops them
+	// and restarts from the last one delivered.
+	eventsPendingLimit = 256
+)
+
+type eventStreamConfig struct {
+	heartbeat    time.Duration
+	writeTimeout time.Duration
+	origins      []string
+}
+
+var getEventStreamConfig = sync.OnceValues(func() (eventStreamConfig, error) {
+	config := eventStreamConfig{heartbeat: defaultEventsHeartbeatInterval, writeTimeout: defaultEventsWriteTimeout}
+	for _, d := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{eventsHeartbeatInterval, &config.heartbeat},
+		{eventsWriteTimeout, &config.writeTimeout},
+	} {
+		value, exists := os.LookupEnv(d.env)
+		if !exists {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return config, fmt.Errorf("invalid %s: %q", d.env, value)
+		}
+		*d.value = duration
+	}
+	if value, exists := os.LookupEnv(eventsAllowedOrigins); exists {
+		for _, origin := range strings.Split(value, ",") {
+			config.origins = append(config.origins, strings.TrimSpace(origin))
+		}
+	}
+	return config, nil
+})
+
+// Event streams share a single NATS connection.
+var getEventsNATSConnection = sync.OnceValues(createNATSConnection)
+
+// streamEvent is what clients receive for every message of the stream.
+type streamEvent struct {
+	Sequence uint64          `json:"sequence"`
+	Subject  string          `json:"subject"`
+	Time     time.Time       `json:"time"`
+	Data     json.RawMessage `json:"data"`
+}
+
+func newStreamEvent(msg *nats.Msg) (*streamEvent, error) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	data := json.RawMessage(msg.Data)
+	if !json.Valid(msg.Data) {
+		data, _ = json.Marshal(string(msg.Data))
+	}
+	return &streamEvent{Sequence: meta.Sequence.Stream, Subject: msg.Subject, Time: meta.Timestamp.UTC(), Data: data}, nil
+}
+
+// eventWriter delivers events to a client, failing when the client does not
+// take them within the write timeout.
+type eventWriter interface {
+	writeEvent(event *streamEvent) error
+	heartbeat() error
+}
+
+// validSubjectFilter checks the syntax of a subject filter.
+func validSubjectFilter(subject string) bool {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return false
+	}
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		if token == "" || (token == ">" && i != len(tokens)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// subjectsOverlap tells whether some subject matches both a and b.
+func subjectsOverlap(a, b string) bool {
+	at, bt := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(at) && i < len(bt); i++ {
+		if at[i] == ">" || bt[i] == ">" {
+			return true
+		}
+		if at[i] != bt[i] && at[i] != "*" && bt[i] != "*" {
+			return false
+		}
+	}
+	return len(at) == len(bt)
+}
+
+// subscribeUserEvents creates an ordered consumer on the users stream
+// matching the subject filters of the request. It starts after the event
+// named by Last-Event-ID, or by the last_event_id query parameter for
+// clients that cannot set headers, and with new events otherwise.
+func subscribeUserEvents(r *http.Request) (*nats.Subscription, int, error) {
+	query := r.URL.Query()
+	filters := query["subject"]
+	for _, filter := range filters {
+		if !validSubjectFilter(filter) {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid subject filter %q", filter)
+		}
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("last_event_id")
+	}
+	var after uint64
+	if lastEventID != "" {
+		var err error
+		if after, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid last event id %q", lastEventID)
+		}
+	}
+
+	stream, err := getNATSStream()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	conn, err := getEventsNATSConnection()
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("could not connect to NATS: %w", err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	if len(filters) > 0 {
+		info, err := js.StreamInfo(stream, nats.Context(r.Context()))
+		if err != nil {
+			return nil, http.StatusServiceUnavailable, err
+		}
+		for _, filter := range filters {
+			if !slices.ContainsFunc(info.Config.Subjects, func(subject string) bool { return subjectsOverlap(filter, subject) }) {
+				return nil, http.StatusBadRequest, fmt.Errorf("subject filter %q matches no subject of the stream", filter)
+			}
+		}
+	}
+	// Ordered consumers use flow control, so clients reading slowly slow the
+	// delivery down instead of piling messages up in the gateway.
+	opts := []nats.SubOpt{nats.BindStream(stream), nats.OrderedConsumer()}
+	if after > 0 {
+		opts = append(opts, nats.StartSequence(after+1))
+	} else {
+		opts = append(opts, nats.DeliverNew())
+	}
+	if len(filters) > 0 {
+		opts = append(opts, nats.ConsumerFilterSubjects(filters...))
+	}
+	sub, err := js.SubscribeSync("", opts...)
+	if err != nil {
+		var apiErr *nats.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest {
+			return nil, http.StatusBadRequest, err
+		}
+		return nil, http.StatusServiceUnavailable, err
+	}
+	if err := sub.SetPendingLimits(eventsPendingLimit, -1); err != nil {
+		sub.Unsubscribe()
+		return nil, http.StatusInternalServerError, err
+	}
+	return sub, 0, nil
+}
+
+// relayEvents writes the messages of sub until ctx is done or the client
+// fails to take them.
+func relayEvents(ctx context.Context, sub *nats.Subscription, writer eventWriter, transport string, config eventStreamConfig) error {
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, config.heartbeat)
+		msg, err := sub.NextMsgWithContext(waitCtx)
+		cancel()
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, context.DeadlineExceeded):
+			if err := writer.heartbeat(); err != nil {
+				return err
+			}
+			continue
+		default:
+			return err
+		}
+		event, err := newStreamEvent(msg)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msgf("skipping message on %s", msg.Subject)
+			continue
+		}
+		if err := writer.writeEvent(event); err != nil {
+			return err
+		}
+		eventStreamEvents.WithLabelValues(transport).Inc()
+	}
+}
+
+type sseWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (s *sseWriter) write(data string) error {
+	if err := s.rc.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if _, err := io.WriteString(s.w, data); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+func (s *sseWriter) writeEvent(event *streamEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.write(fmt.Sprintf("id: %d\ndata: %s\n\n", event.Sequence, data))
+}
+
+func (s *sseWriter) heartbeat() error {
+	return s.write(": heartbeat\n\n")
+}
+
+type webSocketWriter struct {
+	conn    *websocket.Conn
+	timeout time.Duration
+}
+
+func (ws *webSocketWriter) writeEvent(event *streamEvent) error {
+	ws.conn.SetWriteDeadline(time.Now().Add(ws.timeout))
+	return ws.conn.WriteJSON(event)
+}
+
+func (ws *webSocketWriter) heartbeat() error {
+	return ws.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(ws.timeout))
+}
+
+func (c eventStreamConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || slices.Contains(c.origins, "*") || slices.Contains(c.origins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && len(c.origins) == 0 && strings.EqualFold(u.Host, r.Host)
+}
+
+// streamUserEvents serves GET /events/users, relaying the messages of the
+// users stream as Server-Sent Events or, when asked for an upgrade, over a
+// WebSocket. Events carry the stream sequence as id.
+func streamUserEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := zerolog.Ctx(ctx)
+	config, _ := getEventStreamConfig()
+
+	sub, status, err := subscribeUserEvents(r)
+	if err != nil {
+		logger.Error().Err(err).Msg("could not subscribe to user events")
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	var writer eventWriter
+	transport := "sse"
+	if websocket.IsWebSocketUpgrade(r) {
+		transport = "websocket"
+		upgrader := websocket.Upgrader{CheckOrigin: config.checkOrigin}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader already replied.
+			return
+		}
+		defer conn.Close()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		// Clients only send pongs and close frames. The read deadline
+		// disconnects the ones not answering heartbeats.
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(2*config.heartbeat + config.writeTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2*config.heartbeat + config.writeTimeout))
+		})
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		writer = &webSocketWriter{conn: conn, timeout: config.writeTimeout}
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// Keeps nginx from buffering the stream.
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		sse := &sseWriter{w: w, rc: http.NewResponseController(w), timeout: config.writeTimeout}
+		if err := sse.heartbeat(); err != nil {
+			return
+		}
+		writer = sse
+	}
+
+	eventStreamClients.WithLabelValues(transport).Inc()
+	defer eventStreamClients.WithLabelValues(transport).Dec()
+	if err := relayEvents(ctx, sub, writer, transport, config); err != nil {
+		eventStreamDisconnects.WithLabelValues(transport).Inc()
+		logger.Info().Err(err).Msgf("closing %s event stream", transport)
+	}
+}
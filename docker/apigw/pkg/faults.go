@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Port of the HTTP server managing the injected faults on /faults. When not
+// set no fault can be injected.
+const faultsAdminTCPPort = "FAULTS_ADMIN_TCP_PORT"
+
+// faultMatch selects the requests a fault applies to. Empty fields match
+// any request.
+type faultMatch struct {
+	// Route pattern without the version prefix, e.g. /users/{id}.
+	Route  string `json:"route,omitempty"`
+	Method string `json:"method,omitempty"`
+	// Header values the request must have, * for any value.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// faultRule injects a fault in a share of the requests it matches.
+type faultRule struct {
+	Match faultMatch `json:"match"`
+	// Percentage of the matched requests affected, all of them when not
+	// set. 0 pauses the rule.
+	Percent *float64 `json:"percent,omitempty"`
+	// Latency added before the request is served or failed.
+	Delay duration `json:"delay,omitempty"`
+	// Status replied instead of serving the request.
+	Status int `json:"status,omitempty"`
+	// Close the connection without replying.
+	Drop bool `json:"drop,omitempty"`
+}
+
+type faultRules struct {
+	Rules []*faultRule `json:"rules"`
+}
+
+func (f *faultRule) validate() error {
+	if f.Percent != nil && (*f.Percent < 0 || *f.Percent > 100) {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	if f.Delay < 0 {
+		return fmt.Errorf("delay must not be negative")
+	}
+	if f.Status != 0 && (f.Status < 400 || f.Status > 599) {
+		return fmt.Errorf("status must be an error status")
+	}
+	if f.Status != 0 && f.Drop {
+		return fmt.Errorf("a fault either replies a status or drops the request")
+	}
+	if f.Delay == 0 && f.Status == 0 && !f.Drop {
+		return fmt.Errorf("no fault to inject")
+	}
+	return nil
+}
+
+// hit tells whether the rule applies to one of the requests it matches.
+func (f *faultRule) hit() bool {
+	return f.Percent == nil || rand.Float64()*100 < *f.Percent
+}
+
+func (f *faultRule) matches(r *http.Request) bool {
+	if f.Match.Route != "" && f.Match.Route != routePattern(r) {
+		return false
+	}
+	if f.Match.Method != "" && f.Match.Method != r.Method {
+		return false
+	}
+	for name, value := range f.Match.Headers {
+		if actual := r.Header.Get(name); actual == "" || (value != "*" && value != actual) {
+			return false
+		}
+	}
+	return true
+}
+
+// faultInjector adds latency, errors and dropped connections to the
+// requests, for chaos experiments. Its rules are replaced at runtime through
+// the admin server.
+type faultInjector struct {
+	rules atomic.Pointer[faultRules]
+}
+
+// newFaultInjector starts the admin server of the faults on
+// FAULTS_ADMIN_TCP_PORT, returning nil when it is not set.
+func newFaultInjector() *faultInjector {
+	port, exists := os.LookupEnv(faultsAdminTCPPort)
+	if !exists {
+		return nil
+	}
+	f := &faultInjector{}
+	f.rules.Store(&faultRules{Rules: []*faultRule{}})
+	mux := http.NewServeMux()
+	mux.Handle("/faults", f)
+	go func() {
+		log.Printf("Faults admin server listening on port %s", port)
+		if err := http.ListenAndServe(fmt.Sprintf(":%s", port), mux); err != nil {
+			log.Error().Err(err).Msg("faults admin server stopped")
+		}
+	}()
+	return f
+}
+
+// ServeHTTP lists the rules on GET, replaces them with the ones of the body
+// on PUT and removes them on DELETE.
+func (f *faultInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var rules faultRules
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i, rule := range rules.Rules {
+			if err := rule.validate(); err != nil {
+				http.Error(w, fmt.Sprintf("rule %d: %v", i, err), http.StatusBadRequest)
+				return
+			}
+		}
+		f.rules.Store(&rules)
+		log.Warn().Int("rules", len(rules.Rules)).Msg("fault rules replaced")
+	case http.MethodDelete:
+		f.rules.Store(&faultRules{Rules: []*faultRule{}})
+		log.Warn().Msg("fault rules removed")
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.rules.Load())
+}
+
+// pick returns the first rule matching r, unless its percentage misses.
+func (f *faultInjector) pick(r *http.Request) *faultRule {
+	for _, rule := range f.rules.Load().Rules {
+		if rule.matches(r) {
+			if !rule.hit() {
+				return nil
+			}
+			return rule
+		}
+	}
+	return nil
+}
+
+// Middleware injects the faults of the first rule matching a request. It
+// has to run once the route is matched.
+func (f *faultInjector) Middleware(next http.Handler) http.Handler {
+	if f == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule := f.pick(r)
+		if rule == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		logger := zerolog.Ctx(ctx)
+		if rule.Delay > 0 {
+			faultsInjected.WithLabelValues("delay").Inc()
+			logger.Warn().Dur("delay", time.Duration(rule.Delay)).Msg("fault injected: delaying the request")
+			select {
+			case <-time.After(time.Duration(rule.Delay)):
+			case <-ctx.Done():
+				return
+			}
+		}
+		switch {
+		case rule.Drop:
+			faultsInjected.WithLabelValues("drop").Inc()
+			logger.Warn().Msg("fault injected: dropping the request")
+			// The server closes the connection without a response.
+			panic(http.ErrAbortHandler)
+		case rule.Status != 0:
+			faultsInjected.WithLabelValues("status").Inc()
+			logger.Warn().Int("status", rule.Status).Msg("fault injected: failing the request")
+			http.Error(w, "fault injected", rule.Status)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "github.com/fcracker79/k8s-experiment/docker/rest/apigw/proto/user"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// Limits of the queries accepted by /graphql. Depth counts nested
+	// selections, complexity the fields that may be resolved, list fields
+	// multiplying the cost of their selections by their size.
+	graphqlMaxDepth      = "GRAPHQL_MAX_DEPTH"
+	graphqlMaxComplexity = "GRAPHQL_MAX_COMPLEXITY"
+
+	defaultGraphQLMaxDepth      = 8
+	defaultGraphQLMaxComplexity = 1000
+	defaultGraphQLPageSize      = 20
+	// Largest page of users served by the user service.
+	maxGraphQLPageSize = 100
+	// Companies are not paginated, their count is estimated when computing
+	// the complexity of a query.
+	estimatedCompanies = 100
+)
+
+const graphqlForbidden = "FORBIDDEN"
+
+type graphqlLimits struct {
+	maxDepth      int
+	maxComplexity int
+}
+
+var getGraphQLLimits = sync.OnceValues(func() (graphqlLimits, error) {
+	limits := graphqlLimits{maxDepth: defaultGraphQLMaxDepth, maxComplexity: defaultGraphQLMaxComplexity}
+	for _, l := range []struct {
+		env   string
+		value *int
+	}{
+		{graphqlMaxDepth, &limits.maxDepth},
+		{graphqlMaxComplexity, &limits.maxComplexity},
+	} {
+		value, exists := os.LookupEnv(l.env)
+		if !exists {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return limits, fmt.Errorf("invalid %s: %q", l.env, value)
+		}
+		*l.value = n
+	}
+	return limits, nil
+})
+
+// graphqlError carries a machine readable code in the error extensions.
+type graphqlError struct {
+	message string
+	code    string
+}
+
+func (e *graphqlError) Error() string {
+	return e.message
+}
+
+func (e *graphqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+// graphqlRequest is the state shared by the resolvers of a request.
+type graphqlRequest struct {
+	auth    *authenticator
+	loaders *loaders
+}
+
+type graphqlRequestKey struct{}
+
+func graphqlRequestFromContext(ctx context.Context) *graphqlRequest {
+	return ctx.Value(graphqlRequestKey{}).(*graphqlRequest)
+}
+
+// authorize fails unless the caller holds scope.
+func authorize(ctx context.Context, scope string) error {
+	if !graphqlRequestFromContext(ctx).auth.allows(ctx, scope) {
+		return &graphqlError{message: "missing scope " + scope, code: graphqlForbidden}
+	}
+	return nil
+}
+
+// thunk defers a batched load, so that the executor resolves the rest of
+// the level first.
+func thunk[V any](load func() (V, error)) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		value, err := load()
+		return value, err
+	}
+}
+
+func intArg(p graphql.ResolveParams, name string, def int) int {
+	if value, ok := p.Args[name].(int); ok {
+		return value
+	}
+	return def
+}
+
+// firstArg returns the size of the page asked by the first argument of a
+// list field, at most limit.
+func firstArg(p graphql.ResolveParams, limit int) (int, error) {
+	first := intArg(p, "first", defaultGraphQLPageSize)
+	if first <= 0 {
+		return 0, fmt.Errorf("first must be positive, got %d", first)
+	}
+	return min(first, limit), nil
+}
+
+var getGraphQLSchema = sync.OnceValues(newGraphQLSchema)
+
+func newGraphQLSchema() (graphql.Schema, error) {
+	var userType, companyType *graphql.Object
+	userType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+				"name":        &graphql.Field{Type: graphql.String},
+				"description": &graphql.Field{Type: graphql.String},
+				"companyId":   &graphql.Field{Type: graphql.ID},
+				"createdAt":   &graphql.Field{Type: graphql.String},
+				"updatedAt":   &graphql.Field{Type: graphql.String},
+				"company": &graphql.Field{
+					Type: companyType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						user := p.Source.(*pb.User)
+						if user.CompanyId == "" {
+							return nil, nil
+						}
+						if err := authorize(p.Context, scopeCompaniesRead); err != nil {
+							return nil, err
+						}
+						return thunk(graphqlRequestFromContext(p.Context).loaders.companies.load(p.Context, user.CompanyId)), nil
+					},
+				},
+			}
+		}),
+	})
+	companyType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Company",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+				"name":        &graphql.Field{Type: graphql.String},
+				"description": &graphql.Field{Type: graphql.String},
+				"createdAt":   &graphql.Field{Type: graphql.DateTime},
+				"updatedAt":   &graphql.Field{Type: graphql.DateTime},
+				"members": &graphql.Field{
+					Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userType))),
+					Description: fmt.Sprintf("The first users of the company, at most %d.", maxExpandedMembers),
+					Args: graphql.FieldConfigArgument{
+						"first": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultGraphQLPageSize},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if err := authorize(p.Context, scopeUsersRead); err != nil {
+							return nil, err
+						}
+						first, err := firstArg(p, maxExpandedMembers)
+						if err != nil {
+							return nil, err
+						}
+						key := membersKey{companyID: p.Source.(*Company).ID, first: int32(first)}
+						return thunk(graphqlRequestFromContext(p.Context).loaders.members.load(p.Context, key)), nil
+					},
+				},
+			}
+		}),
+	})
+	userPageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserPage",
+		Fields: graphql.Fields{
+			"items":         &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userType)))},
+			"nextPageToken": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := authorize(p.Context, scopeUsersRead); err != nil {
+						return nil, err
+					}
+					return thunk(graphqlRequestFromContext(p.Context).loaders.users.load(p.Context, p.Args["id"].(string))), nil
+				},
+			},
+			"users": &graphql.Field{
+				Type: graphql.NewNonNull(userPageType),
+				Args: graphql.FieldConfigArgument{
+					"companyId": &graphql.ArgumentConfig{Type: graphql.ID},
+					"first":     &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultGraphQLPageSize},
+					"after":     &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := authorize(p.Context, scopeUsersRead); err != nil {
+						return nil, err
+					}
+					first, err := firstArg(p, maxGraphQLPageSize)
+					if err != nil {
+						return nil, err
+					}
+					c, err := graphqlRequestFromContext(p.Context).loaders.client()
+					if err != nil {
+						return nil, err
+					}
+					companyID, _ := p.Args["companyId"].(string)
+					after, _ := p.Args["after"].(string)
+					response, err := c.ListUsers(p.Context, &pb.ListUsersRequest{
+						CompanyId: companyID,
+						PageSize:  int32(first),
+						PageToken: after,
+					})
+					if err != nil {
+						return nil, err
+					}
+					return map[string]interface{}{
+						"items":         response.Users,
+						"nextPageToken": response.NextPageToken,
+					}, nil
+				},
+			},
+			"company": &graphql.Field{
+				Type: companyType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := authorize(p.Context, scopeCompaniesRead); err != nil {
+						return nil, err
+					}
+					return thunk(graphqlRequestFromContext(p.Context).loaders.companies.load(p.Context, p.Args["id"].(string))), nil
+				},
+			},
+			"companies": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(companyType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := authorize(p.Context, scopeCompaniesRead); err != nil {
+						return nil, err
+					}
+					return fetchAllCompanies(p.Context)
+				},
+			},
+		},
+	})
+
+	userInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UserInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"id":          &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.ID)},
+			"name":        &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"description": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"companyId":   &graphql.InputObjectFieldConfig{Type: graphql.ID},
+		},
+	})
+	companyInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "CompanyInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"id":          &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.ID)},
+			"name":        &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"description": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(userInput)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := authorize(p.Context, scopeUsersWrite); err != nil {
+						return nil, err
+					}
+					c, err := graphqlRequestFromContext(p.Context).loaders.client()
+					if err != nil {
+						return nil, err
+					}
+					input := p.Args["input"].(map[string]interface{})
+					user := &pb.User{Id: input["id"].(string)}
+					user.Name, _ = input["name"].(string)
+					user.Description, _ = input["description"].(string)
+					user.CompanyId, _ = input["companyId"].(string)
+					return c.CreateUser(p.Context, user)
+				},
+			},
+			"deleteUser": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := authorize(p.Context, scopeUsersWrite); err != nil {
+						return nil, err
+					}
+					c, err := graphqlRequestFromContext(p.Context).loaders.client()
+					if err != nil {
+						return nil, err
+					}
+					if _, err := c.DeleteUser(p.Context, &pb.User{Id: p.Args["id"].(string)}); err != nil {
+						return nil, err
+					}
+					return true, nil
+				},
+			},
+			"createCompany": &graphql.Field{
+				Type: graphql.NewNonNull(companyType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(companyInput)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := authorize(p.Context, scopeCompaniesWrite); err != nil {
+						return nil, err
+					}
+					input := p.Args["input"].(map[string]interface{})
+					company := &Company{ID: input["id"].(string)}
+					company.Name, _ = input["name"].(string)
+					company.Description, _ = input["description"].(string)
+					return postCompany(p.Context, company)
+				},
+			},
+			"deleteCompany": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := authorize(p.Context, scopeCompaniesWrite); err != nil {
+						return nil, err
+					}
+					if err := removeCompany(p.Context, p.Args["id"].(string)); err != nil {
+						return nil, err
+					}
+					return true, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+// postCompany creates a company through the company service.
+func postCompany(ctx context.Context, company *Company) (*Company, error) {
+	data, err := json.Marshal(company)
+	if err != nil {
+		return nil, err
+	}
+	req, err := newHTTPRequest(ctx, http.MethodPost, fmt.Sprintf("%s/companies", getCompanyHttpEndpoint()), strings.NewReader(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := getHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("company service replied %s", resp.Status)
+	}
+	var created Company
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return nil, fmt.Errorf("company service replied with invalid JSON: %w", err)
+	}
+	return &created, nil
+}
+
+// removeCompany deletes a company through the company service.
+func removeCompany(ctx context.Context, id string) error {
+	req, err := newHTTPRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/companies/%s", getCompanyHttpEndpoint(), id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := getHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("company service replied %s", resp.Status)
+	}
+	return nil
+}
+
+// queryCost computes the depth and the complexity of an operation.
+// Introspection fields are free.
+type queryCost struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+	// Fragments being walked, to stop on cycles; validation reports them.
+	visiting map[string]bool
+}
+
+func (c *queryCost) listSize(field *ast.Field) int {
+	switch field.Name.Value {
+	case "companies":
+		return estimatedCompanies
+	case "users":
+		return c.first(field, maxGraphQLPageSize)
+	case "members":
+		return c.first(field, maxExpandedMembers)
+	}
+	return 1
+}
+
+// first returns the page size asked by a list field within [1, limit], as
+// served by its resolver, which rejects the sizes below 1.
+func (c *queryCost) first(field *ast.Field, limit int) int {
+	n := defaultGraphQLPageSize
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "first" {
+			continue
+		}
+		switch value := arg.Value.(type) {
+		case *ast.IntValue:
+			if v, err := strconv.Atoi(value.Value); err == nil {
+				n = v
+			}
+		case *ast.Variable:
+			if v, ok := c.variables[value.Name.Value].(float64); ok {
+				n = int(v)
+			}
+		}
+	}
+	return min(max(n, 1), limit)
+}
+
+func (c *queryCost) selectionSet(set *ast.SelectionSet) (depth, complexity int) {
+	if set == nil {
+		return 0, 0
+	}
+	for _, selection := range set.Selections {
+		var d, n int
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(selection.Name.Value, "__") {
+				continue
+			}
+			d, n = c.selectionSet(selection.SelectionSet)
+			d, n = d+1, 1+n*c.listSize(selection)
+		case *ast.InlineFragment:
+			d, n = c.selectionSet(selection.SelectionSet)
+		case *ast.FragmentSpread:
+			name := selection.Name.Value
+			fragment, ok := c.fragments[name]
+			if !ok || c.visiting[name] {
+				continue
+			}
+			c.visiting[name] = true
+			d, n = c.selectionSet(fragment.SelectionSet)
+			delete(c.visiting, name)
+		}
+		depth = max(depth, d)
+		complexity += n
+	}
+	return depth, complexity
+}
+
+// checkLimits rejects queries deeper or more complex than allowed. Queries
+// that do not parse are left to the executor, which reports a better error.
+func checkLimits(query, operationName string, variables map[string]interface{}, limits graphqlLimits) error {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return nil
+	}
+	c := &queryCost{
+		fragments: make(map[string]*ast.FragmentDefinition),
+		variables: variables,
+		visiting:  make(map[string]bool),
+	}
+	var operations []*ast.OperationDefinition
+	for _, definition := range doc.Definitions {
+		switch definition := definition.(type) {
+		case *ast.FragmentDefinition:
+			c.fragments[definition.Name.Value] = definition
+		case *ast.OperationDefinition:
+			if operationName == "" || (definition.Name != nil && definition.Name.Value == operationName) {
+				operations = append(operations, definition)
+			}
+		}
+	}
+	if len(operations) != 1 {
+		return nil
+	}
+	depth, complexity := c.selectionSet(operations[0].SelectionSet)
+	if depth > limits.maxDepth {
+		return fmt.Errorf("query depth %d exceeds the limit of %d", depth, limits.maxDepth)
+	}
+	if complexity > limits.maxComplexity {
+		return fmt.Errorf("query complexity %d exceeds the limit of %d", complexity, limits.maxComplexity)
+	}
+	return nil
+}
+
+func writeGraphQLResult(w http.ResponseWriter, status int, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// graphqlRequestError rejects a request before it is executed.
+func graphqlRequestError(w http.ResponseWriter, message string) {
+	writeGraphQLResult(w, http.StatusBadRequest, map[string]interface{}{
+		"errors": []map[string]string{{"message": message}},
+	})
+}
+
+// graphqlHandler serves POST /graphql. Authorization is checked per field,
+// with the same scopes as the REST routes.
+func graphqlHandler(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		var params struct {
+			Query         string                 `json:"query"`
+			OperationName string                 `json:"operationName"`
+			Variables     map[string]interface{} `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			graphqlRequestError(w, "invalid request body: "+err.Error())
+			return
+		}
+		schema, _ := getGraphQLSchema()
+		limits, _ := getGraphQLLimits()
+		if err := checkLimits(params.Query, params.OperationName, params.Variables, limits); err != nil {
+			zerolog.Ctx(ctx).Info().Err(err).Msg("rejected GraphQL query")
+			graphqlRequestError(w, err.Error())
+			return
+		}
+
+		request := &graphqlRequest{auth: auth, loaders: newLoaders(ctx)}
+		defer request.loaders.close()
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  params.Query,
+			OperationName:  params.OperationName,
+			VariableValues: params.Variables,
+			Context:        context.WithValue(ctx, graphqlRequestKey{}, request),
+		})
+		writeGraphQLResult(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Path of the JSON configuration of CORS, request body limits and response
+// compression, see httpPolicyConfig. When not set the defaults apply: no
+// cross-origin access, 1 MiB bodies and compressed responses.
+const httpPolicyConfigFile = "HTTP_POLICY_CONFIG"
+
+const (
+	defaultMaxBodySize = 1 << 20
+	// Imports stream their body to the user service, they are allowed more.
+	defaultImportMaxBodySize  = 1 << 30
+	defaultCompressionMinSize = 1024
+	defaultCORSMaxAge         = 10 * time.Minute
+)
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", idempotencyKeyHeader, requestIDHeader, "Last-Event-ID", "If-None-Match", canaryHeader}
+	// Browsers only let scripts read the CORS-safelisted response headers
+	// and these ones.
+	defaultCORSExposedHeaders = []string{"ETag", "Idempotent-Replayed", "Retry-After", requestIDHeader, "X-Cache",
+		"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", upstreamTargetHeader}
+	defaultCompressionEncodings = []string{"zstd", "gzip"}
+)
+
+type corsPolicy struct {
+	// Path prefixes the policy applies to, e.g. "/users". The first policy
+	// matching a path wins.
+	Paths []string `json:"paths"`
+	// Origins allowed to call the routes: exact origins, "*" for any or
+	// "https://*.example.com" for the subdomains of a domain.
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// How long browsers may cache preflight responses, e.g. "10m".
+	MaxAge string `json:"max_age"`
+
+	maxAge time.Duration
+}
+
+type routeBodyLimit struct {
+	Method      string `json:"method"`
+	Pattern     string `json:"pattern"`
+	MaxBodySize int64  `json:"max_body_size"`
+}
+
+// httpPolicyConfig is the content of HTTP_POLICY_CONFIG, e.g.
+//
+//	{
+//	  "cors": [
+//	    {"paths": ["/users", "/companies"], "allowed_origins": ["https://app.example.com"], "allow_credentials": true},
+//	    {"paths": ["/openapi.json"], "allowed_origins": ["*"], "allowed_methods": ["GET"]}
+//	  ],
+//	  "max_body_size": 1048576,
+//	  "routes": [
+//	    {"method": "POST", "pattern": "/users/import", "max_body_size": 1073741824}
+//	  ],
+//	  "compression": {"encodings": ["zstd", "gzip"], "min_size": 1024}
+//	}
+//
+// Sizes are in bytes, 0 meaning unlimited. Routes not listed in routes
+// accept bodies up to max_body_size, patterns have no version prefix; an
+// empty list of encodings disables compression.
+type httpPolicyConfig struct {
+	CORS        []*corsPolicy    `json:"cors"`
+	MaxBodySize *int64           `json:"max_body_size"`
+	Routes      []routeBodyLimit `json:"routes"`
+	Compression struct {
+		Encodings []string `json:"encodings"`
+		MinSize   *int     `json:"min_size"`
+	} `json:"compression"`
+}
+
+// httpPolicy applies HTTP_POLICY_CONFIG. A nil policy lets everything
+// through.
+type httpPolicy struct {
+	cors         []*corsPolicy
+	maxBodySize  int64
+	routeLimits  map[string]int64
+	encodings    []string
+	compressSize int
+}
+
+func newHTTPPolicy() (*httpPolicy, error) {
+	var config httpPolicyConfig
+	if path, exists := os.LookupEnv(httpPolicyConfigFile); exists {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", httpPolicyConfigFile, err)
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", httpPolicyConfigFile, err)
+		}
+	}
+
+	p := &httpPolicy{
+		maxBodySize:  defaultMaxBodySize,
+		routeLimits:  map[string]int64{"POST /users/import": defaultImportMaxBodySize},
+		encodings:    defaultCompressionEncodings,
+		compressSize: defaultCompressionMinSize,
+	}
+	if config.MaxBodySize != nil {
+		p.maxBodySize = *config.MaxBodySize
+	}
+	for _, route := range config.Routes {
+		p.routeLimits[strings.ToUpper(route.Method)+" "+route.Pattern] = route.MaxBodySize
+	}
+	if config.Compression.Encodings != nil {
+		p.encodings = nil
+		for _, encoding := range config.Compression.Encodings {
+			encoding = strings.ToLower(encoding)
+			if _, ok := compressors[encoding]; !ok {
+				return nil, fmt.Errorf("%s: unsupported encoding %q", httpPolicyConfigFile, encoding)
+			}
+			p.encodings = append(p.encodings, encoding)
+		}
+	}
+	if config.Compression.MinSize != nil {
+		p.compressSize = *config.Compression.MinSize
+	}
+
+	for i, policy := range config.CORS {
+		if len(policy.Paths) == 0 || len(policy.AllowedOrigins) == 0 {
+			return nil, fmt.Errorf("%s: CORS policy #%d needs paths and allowed_origins", httpPolicyConfigFile, i+1)
+		}
+		if policy.AllowCredentials && slices.Contains(policy.AllowedOrigins, "*") {
+			return nil, fmt.Errorf("%s: CORS policy #%d cannot allow credentials from any origin", httpPolicyConfigFile, i+1)
+		}
+		if policy.AllowedMethods == nil {
+			policy.AllowedMethods = defaultCORSMethods
+		}
+		if policy.AllowedHeaders == nil {
+			policy.AllowedHeaders = defaultCORSHeaders
+		}
+		if policy.ExposedHeaders == nil {
+			policy.ExposedHeaders = defaultCORSExposedHeaders
+		}
+		policy.maxAge = defaultCORSMaxAge
+		if policy.MaxAge != "" {
+			var err error
+			if policy.maxAge, err = time.ParseDuration(policy.MaxAge); err != nil {
+				return nil, fmt.Errorf("%s: CORS policy #%d: invalid max_age: %w", httpPolicyConfigFile, i+1, err)
+			}
+		}
+		p.cors = append(p.cors, policy)
+	}
+	return p, nil
+}
+
+// bodyReadError replies to a failure reading the request body.
+func bodyReadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, fmt.Sprintf("could not read request body: %s", err), http.StatusBadRequest)
+}
+
+// LimitBody rejects the request bodies larger than the limit of their route
+// with a 413. It has to run once the route is matched.
+func (p *httpPolicy) LimitBody(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := p.routeLimits[r.Method+" "+routePattern(r)]
+		if !ok {
+			limit = p.maxBodySize
+		}
+		if limit > 0 && r.Body != nil && r.Body != http.NoBody {
+			if r.ContentLength > limit {
+				bodyReadError(w, &http.MaxBytesError{Limit: limit})
+				return
+			}
+			// Bodies without a length fail once they go past the limit.
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *corsPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if scheme, domain, found := strings.Cut(allowed, "://*."); found &&
+			strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(strings.ToLower(origin), "."+strings.ToLower(domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *corsPolicy) allowsHeaders(requested string) bool {
+	if slices.Contains(c.AllowedHeaders, "*") && !c.AllowCredentials {
+		return true
+	}
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !slices.ContainsFunc(c.AllowedHeaders, func(allowed string) bool { return strings.EqualFold(allowed, header) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// corsPolicy returns the policy of a path, matched with and without its
+// version prefix, so that a policy on /users covers /v1/users and
+// /v2/users too.
+func (p *httpPolicy) corsPolicy(path string) *corsPolicy {
+	unversioned := unversionedPath(path)
+	for _, policy := range p.cors {
+		for _, prefix := range policy.Paths {
+			for _, path := range []string{path, unversioned} {
+				if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+					return policy
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CORS lets browsers call the routes covered by a CORS policy from the
+// origins it allows, answering their preflight requests. It has to run
+// before authentication, since preflight requests carry no credentials.
+func (p *httpPolicy) CORS(next http.Handler) http.Handler {
+	if p == nil || len(p.cors) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		policy := p.corsPolicy(r.URL.Path)
+		if origin == "" || policy == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+		if !policy.allowsOrigin(origin) {
+			if preflight {
+				http.Error(w, fmt.Sprintf("origin %s is not allowed", origin), http.StatusForbidden)
+				return
+			}
+			// Browsers keep the response from the script.
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if policy.AllowCredentials || !slices.Contains(policy.AllowedOrigins, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		if policy.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if len(policy.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		method := r.Header.Get("Access-Control-Request-Method")
+		if !slices.Contains(policy.AllowedMethods, method) {
+			http.Error(w, fmt.Sprintf("method %s is not allowed", method), http.StatusForbidden)
+			return
+		}
+		if requested := r.Header.Get("Access-Control-Request-Headers"); !policy.allowsHeaders(requested) {
+			http.Error(w, fmt.Sprintf("headers %s are not allowed", requested), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.AllowedMethods, ", "))
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			w.Header().Set("Access-Control-Allow-Headers", requested)
+		}
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.maxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// How long the responses of requests carrying an Idempotency-Key are
+	// kept for retries, 0 disables them.
+	idempotencyTTL = "IDEMPOTENCY_TTL"
+	// Maximum number of responses kept.
+	idempotencyMaxEntries = "IDEMPOTENCY_MAX_ENTRIES"
+
+	defaultIdempotencyTTL        = 24 * time.Hour
+	defaultIdempotencyMaxEntries = 10000
+	idempotencyKeyHeader         = "Idempotency-Key"
+	maxIdempotencyKeyLength      = 255
+)
+
+type idempotentResponse struct {
+	fingerprint string
+	// Closed once the first request is done, status is 0 until then.
+	done    chan struct{}
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// idempotencyStore keeps the first response to every request carrying an
+// Idempotency-Key, so that retries get it instead of repeating the write.
+// Responses are kept in memory, each replica has its own.
+type idempotencyStore struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+// newIdempotencyStore returns nil when IDEMPOTENCY_TTL is 0.
+func newIdempotencyStore() (*idempotencyStore, error) {
+	ttl := defaultIdempotencyTTL
+	if value, exists := os.LookupEnv(idempotencyTTL); exists {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid %s: %q", idempotencyTTL, value)
+		}
+	}
+	if ttl == 0 {
+		return nil, nil
+	}
+	maxEntries := defaultIdempotencyMaxEntries
+	if value, exists := os.LookupEnv(idempotencyMaxEntries); exists {
+		var err error
+		if maxEntries, err = strconv.Atoi(value); err != nil || maxEntries <= 0 {
+			return nil, fmt.Errorf("invalid %s: %q", idempotencyMaxEntries, value)
+		}
+	}
+	s := &idempotencyStore{ttl: ttl, maxEntries: maxEntries, entries: make(map[string]*idempotentResponse)}
+	go s.purge()
+	return s, nil
+}
+
+// idempotencyKey returns the Idempotency-Key of r scoped to its principal,
+// so that clients cannot replay each other's responses, or "" when there is
+// none.
+func idempotencyKey(r *http.Request) string {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		return ""
+	}
+	if p, ok := principalFromContext(r.Context()); ok {
+		return p.Subject + ":" + key
+	}
+	return key
+}
+
+// requestFingerprint identifies the method, path and body of a request.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// begin returns the entry of key, creating it when there is none. created
+// tells whether the caller has to run the request and finish the entry.
+func (s *idempotencyStore) begin(key, fingerprint string) (entry *idempotentResponse, created bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if entry, ok := s.entries[key]; ok && (entry.status == 0 || now.Before(entry.expires)) {
+		return entry, false
+	}
+	if len(s.entries) >= s.maxEntries {
+		s.evictExpired(now)
+		if len(s.entries) >= s.maxEntries {
+			// Make room by dropping any finished entry.
+			for victim, e := range s.entries {
+				if e.status != 0 {
+					delete(s.entries, victim)
+					break
+				}
+			}
+		}
+	}
+	entry = &idempotentResponse{fingerprint: fingerprint, done: make(chan struct{})}
+	s.entries[key] = entry
+	idempotencyEntries.Set(float64(len(s.entries)))
+	return entry, true
+}
+
+// finish stores the response of the request that created entry. Server
+// errors are not kept, so that retries run the request again.
+func (s *idempotencyStore) finish(key string, entry *idempotentResponse, recorder *responseRecorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer close(entry.done)
+	if recorder.status >= http.StatusInternalServerError || recorder.status == http.StatusTooManyRequests {
+		delete(s.entries, key)
+		idempotencyEntries.Set(float64(len(s.entries)))
+		return
+	}
+	entry.status = recorder.status
+	entry.header = recorder.header
+	entry.body = recorder.body.Bytes()
+	entry.expires = time.Now().Add(s.ttl)
+}
+
+func (s *idempotencyStore) evictExpired(now time.Time) {
+	for key, entry := range s.entries {
+		if entry.status != 0 && now.After(entry.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+func (s *idempotencyStore) purge() {
+	for now := range time.Tick(time.Minute) {
+		s.mu.Lock()
+		s.evictExpired(now)
+		idempotencyEntries.Set(float64(len(s.entries)))
+		s.mu.Unlock()
+	}
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, entry *idempotentResponse) {
+	for name, values := range entry.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// Middleware runs the first request with a given Idempotency-Key and
+// replays its response to the following ones. Requests reusing a key with
+// a different method, path or body, or while the first one is still running,
+// are rejected with a 409; once the first one failed without a stored
+// response, the key is free again. Requests without a key are let through.
+func (s *idempotencyStore) Middleware(next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := idempotencyKey(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(r.Header.Get(idempotencyKeyHeader)) > maxIdempotencyKeyLength {
+			http.Error(w, fmt.Sprintf("%s is longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength), http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxValidatedBodySize+1))
+		if err != nil {
+			bodyReadError(w, err)
+			return
+		}
+		if len(body) > maxValidatedBodySize {
+			http.Error(w, fmt.Sprintf("request body is larger than %d bytes", maxValidatedBodySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+
+		entry, created := s.begin(key, fingerprint)
+		if !created {
+			select {
+			case <-entry.done:
+			default:
+				idempotencyRequests.WithLabelValues("in_progress").Inc()
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, fmt.Sprintf("a request with this %s is in progress", idempotencyKeyHeader), http.StatusConflict)
+				return
+			}
+			if entry.status == 0 {
+				// The first request failed and was dropped, run this one,
+				// whatever it was: there is no response to mismatch.
+				s.Middleware(next).ServeHTTP(w, r)
+				return
+			}
+			if entry.fingerprint != fingerprint {
+				idempotencyRequests.WithLabelValues("mismatch").Inc()
+				http.Error(w, fmt.Sprintf("%s was already used for a different request", idempotencyKeyHeader), http.StatusConflict)
+				return
+			}
+			idempotencyRequests.WithLabelValues("replayed").Inc()
+			zerolog.Ctx(r.Context()).Info().Msgf("replaying response for %s", idempotencyKeyHeader)
+			replayIdempotentResponse(w, entry)
+			return
+		}
+
+		recorder := &responseRecorder{header: make(http.Header)}
+		func() {
+			// Panicking handlers must not leave the key in progress.
+			completed := false
+			defer func() {
+				if !completed {
+					recorder.status = http.StatusInternalServerError
+				} else if recorder.status == 0 {
+					recorder.status = http.StatusOK
+				}
+				s.finish(key, entry, recorder)
+			}()
+			next.ServeHTTP(recorder, r)
+			completed = true
+		}()
+		if entry.status != 0 {
+			idempotencyRequests.WithLabelValues("stored").Inc()
+		}
+		for name, values := range recorder.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(recorder.status)
+		w.Write(recorder.body.Bytes())
+	})
+}
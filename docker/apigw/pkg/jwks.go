@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/singleflight"
+)
+
+// An unknown key id triggers a refresh of the key set, unless one was
+// attempted, successfully or not, less than this ago.
+const jwksMinRefreshInterval = 30 * time.Second
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwks holds the verification keys of a JSON Web Key Set read from a file or
+// an http(s) URL, refreshed periodically so that rotated keys are picked up.
+type jwks struct {
+	source string
+	client *http.Client
+	// Coalesces the refreshes triggered by unknown key ids.
+	group singleflight.Group
+
+	mu          sync.RWMutex
+	keys        map[string]crypto.PublicKey
+	lastAttempt time.Time
+}
+
+func newJWKS(source string) *jwks {
+	return &jwks{
+		source: source,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (k *jwks) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(k.source, "http://") && !strings.HasPrefix(k.source, "https://") {
+		return os.ReadFile(k.source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", k.source, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (k *jwks) refresh(ctx context.Context) error {
+	k.mu.Lock()
+	k.lastAttempt = time.Now()
+	k.mu.Unlock()
+	data, err := k.read(ctx)
+	if err != nil {
+		return fmt.Errorf("could not read JWKS: %w", err)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("could not parse JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Warn().Err(err).Msgf("skipping JWK %q", jwk.Kid)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS has no usable signing keys")
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// run refreshes the key set every interval until ctx is done.
+func (k *jwks) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.refresh(ctx); err != nil {
+				log.Error().Err(err).Msg("could not refresh JWKS, keeping the previous keys")
+			}
+		}
+	}
+}
+
+func (k *jwks) lookup(kid string) (crypto.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+// keyfunc returns a jwt.Keyfunc returning the key named by the token's kid
+// header, for a request with context ctx.
+func (k *jwks) keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if key, ok := k.lookup(kid); ok {
+			return key, nil
+		}
+		k.refreshUnknown(ctx)
+		if key, ok := k.lookup(kid); ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+}
+
+// refreshUnknown refreshes the key set for a token with an unknown key id,
+// unless a refresh was attempted less than jwksMinRefreshInterval ago. The
+// requests arriving meanwhile wait for the same refresh.
+func (k *jwks) refreshUnknown(ctx context.Context) {
+	result := k.group.DoChan("refresh", func() (interface{}, error) {
+		k.mu.RLock()
+		stale := time.Since(k.lastAttempt) > jwksMinRefreshInterval
+		k.mu.RUnlock()
+		if !stale {
+			return nil, nil
+		}
+		// The refresh is shared, it does not end with the request running it.
+		if err := k.refresh(context.WithoutCancel(ctx)); err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("could not refresh JWKS")
+		}
+		return nil, nil
+	})
+	select {
+	case <-result:
+	case <-ctx.Done():
+	}
+}
+
+func decodeBase64URL(field, value string) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid %s", field)
+	}
+	return data, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBase64URL("n", jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URL("e", jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBase64URL("x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URL("y", jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBase64URL("x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
@@ -107,6 +107,7 @@ func LogMiddleware(next http.Handler) http.Handler {
 		}
 
 		log := zerolog.New(os.Stderr).With().Timestamp().
+			Str("requestId", requestIDFromContext(r.Context())).
 			Str("traceId", string(traceID)).
 			Str("spanId", string(spanID)).
 			Logger()
@@ -135,32 +136,126 @@ func main() {
 	if err != nil {
 		log.Fatal().Err(err).Msg("could not initialize NATS")
 	}
-	startHTTPServer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	auth, err := newAuthenticator(ctx)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not initialize authentication")
+	}
+	limiter, err := newRateLimiter()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not initialize rate limiting")
+	}
+	if _, err := getUpstreams(); err != nil {
+		log.Fatal().Err(err).Msg("could not initialize resilience policies")
+	}
+	if _, err := getUserTransportCredentials(); err != nil {
+		log.Fatal().Err(err).Msg("could not initialize the user service TLS")
+	}
+	if _, err := getServiceIdentity(); err != nil {
+		log.Fatal().Err(err).Msg("could not initialize the service identity")
+	}
+	if _, err := getAggregateTimeout(); err != nil {
+		log.Fatal().Err(err).Msg("could not initialize aggregation")
+	}
+	if _, err := getGraphQLSchema(); err != nil {
+		log.Fatal().Err(err).Msg("could not initialize the GraphQL schema")
+	}
+	if _, err := getGraphQLLimits(); err != nil {
+		log.Fatal().Err(err).Msg("could not initialize the GraphQL limits")
+	}
+	if _, err := getEventStreamConfig(); err != nil {
+		log.Fatal().Err(err).Msg("could not initialize event streams")
+	}
+	if _, err := getAPIVersions(); err != nil {
+		log.Fatal().Err(err).Msg("could not initialize the API versions")
+	}
+	caches, err := newResponseCaches()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not initialize response caches")
+	}
+	validator, err := newRequestValidator()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not initialize request validation")
+	}
+	idempotency, err := newIdempotencyStore()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not initialize idempotency keys")
+	}
+	policy, err := newHTTPPolicy()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not initialize the HTTP policy")
+	}
+	faults := newFaultInjector()
+	recorder, err := newTrafficRecorder()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not initialize the traffic recording")
+	}
+	router, err := newRouteReloader(func(routes *routesConfig) http.Handler {
+		return newRouter(routes, auth, limiter, caches, validator, idempotency, policy, faults, recorder)
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not initialize the routes")
+	}
+	go router.watch(ctx)
+	startMetricsServer()
+	startHTTPServer(router)
+}
+
+func startHTTPServer(handler http.Handler) {
+	tcpPort := getEnvString("TCP_PORT")
+	fmt.Printf("Listening port %s\n", tcpPort)
+	http.ListenAndServe(fmt.Sprintf(":%s", tcpPort), handler)
 }
 
-func startHTTPServer() {
+func newRouter(routes *routesConfig, auth *authenticator, limiter *rateLimiter, caches *responseCaches, validator *requestValidator, idempotency *idempotencyStore, policy *httpPolicy, faults *faultInjector, recorder *trafficRecorder) chi.Router {
 	r := chi.NewRouter()
 
 	r.Use(otelchi.Middleware("apigw", otelchi.WithChiRoutes(r)))
+	r.Use(RequestIDMiddleware)
 	r.Use(LogMiddleware)
+	r.Use(policy.CORS)
+	r.Use(policy.Compress)
+	r.Use(auth.Middleware)
+
+	// Inline middlewares run once the route is matched, so that limits and
+	// operations can be looked up by route pattern. Versions are groups
+	// rather than mounted subrouters for the same reason.
+	guard := func(r chi.Router) {
+		r.Use(recorder.Middleware)
+		r.Use(faults.Middleware)
+		r.Use(limiter.Middleware)
+		r.Use(policy.LimitBody)
+		r.Use(validator.Middleware)
+	}
+	versions, _ := getAPIVersions()
+	for _, version := range versions {
+		r.Group(func(r chi.Router) {
+			r.Use(version.Middleware)
+			guard(r)
+			versionRoutes(r, version.prefix, routes, auth, caches, idempotency)
+		})
+	}
+	r.Group(func(r chi.Router) {
+		guard(r)
+
+		// Event endpoints and GraphQL do not depend on the representations
+		// of the versions
+		r.With(auth.require(scopeUsersRead)).Get("/events/users", streamUserEvents)
+		// GraphQL authorizes each field on its own
+		r.Post("/graphql", graphqlHandler(auth))
+	})
+	return r
+}
 
-	// User endpoints
-	r.Get("/users/{id}", getUser)
-	r.Post("/users", createUser)
-	r.Delete("/users/{id}", deleteUser)
-
-	// Company endpoints
-	r.Get("/companies/{id}", getCompany)
-	r.Get("/companies", getAllCompanies)
-	r.Post("/companies", createCompany)
-	r.Delete("/companies/{id}", deleteCompany)
-
-	// Async endpoints
-	r.Post("/async/users", asyncCreateUser)
-
-	tcpPort := getEnvString("TCP_PORT")
-	fmt.Printf("Listening port %s\n", tcpPort)
-	http.ListenAndServe(fmt.Sprintf(":%s", tcpPort), r)
+// versionRoutes registers the routes of an API version under prefix: its
+// OpenAPI document and the configured routes.
+func versionRoutes(r chi.Router, prefix string, routes *routesConfig, auth *authenticator, caches *responseCaches, idempotency *idempotencyStore) {
+	r.Get(prefix+"/openapi.json", serveOpenAPI)
+	for _, route := range routes.Routes {
+		r.With(route.middlewares(auth, caches, idempotency)...).Method(route.Method, prefix+route.Path, route.handler)
+	}
 }
 
 func getUserGrpcEndpoint() string {
@@ -182,243 +277,153 @@ func getEnvString(env string) string {
 func getUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	id := chi.URLParam(r, "id")
-	connection, err := createGrpcConnection()
+	connection, err := createGrpcConnection(ctx)
 	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("did not connect")
+		zerolog.Ctx(ctx).Error().Err(err).Msg("did not connect")
+		http.Error(w, "user service unavailable", http.StatusBadGateway)
+		return
 	}
 	defer connection.Close()
 	c := pb.NewUserServiceClient(connection)
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
 	user, err := c.GetUser(ctx, &pb.User{Id: id})
 	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not fetch user")
+		zerolog.Ctx(ctx).Error().Err(err).Msg("could not fetch user")
+		http.Error(w, err.Error(), grpcStatusToHTTP(err))
+		return
 	}
-	data, _ := json.Marshal(user)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	writeMessage(w, r, http.StatusOK, representationFromContext(ctx).user(user), user)
 }
 
 func createUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Fatal().Err(err).Msg("could not read request body")
+		bodyReadError(w, err)
+		return
 	}
-	var user pb.User
-	err = json.Unmarshal(body, &user)
+	representation := representationFromContext(ctx)
+	user, err := representation.parseUser(body)
 	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not unmarshal request body")
+		http.Error(w, fmt.Sprintf("request body is not a valid user: %s", err), http.StatusBadRequest)
+		return
 	}
-	connection, err := createGrpcConnection()
+	connection, err := createGrpcConnection(ctx)
 	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("did not connect")
+		zerolog.Ctx(ctx).Error().Err(err).Msg("did not connect")
+		http.Error(w, "user service unavailable", http.StatusBadGateway)
+		return
 	}
 	defer connection.Close()
 	c := pb.NewUserServiceClient(connection)
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
-	createdUser, err := c.CreateUser(ctx, &user)
+	createdUser, err := c.CreateUser(ctx, user)
 	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not create user")
+		zerolog.Ctx(ctx).Error().Err(err).Msg("could not create user")
+		http.Error(w, err.Error(), grpcStatusToHTTP(err))
+		return
 	}
-	data, _ := json.Marshal(createdUser)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
-}
-
-func asyncCreateUser(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	logger := zerolog.Ctx(ctx)
-
-	logger.Info().Msgf("Received async create user request, ctx %v+", ctx)
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("could not read request body")
-	}
-
-	conn, err := createNATSConnection()
-	if err != nil {
-		logger.Fatal().Err(err).Msg("could not connect to NATS")
-	}
-
-	subject, err := getCreateUserNATSSubject()
-	if err != nil {
-		logger.Fatal().Err(err).Msg("could not get NATS subject")
-	}
-	header := make(nats.Header)
-
-	_, span := tracer.Start(ctx, "PublishWithTrace")
-	defer span.End()
-
-	headerCarrier := propagation.HeaderCarrier(header)
-	otel.GetTextMapPropagator().Inject(ctx, headerCarrier)
-	logger.Info().Msgf("Publishing message to subject %s, headers %v, headerCarrier %v", subject, header, headerCarrier)
-	msg := &nats.Msg{
-		Subject: subject,
-		Data:    body,
-		Header:  header,
-	}
-
-	if conn.PublishMsg(msg); err != nil {
-		logger.Fatal().Err(err).Msg("could not publish message")
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
+	status := representation.created(w, resourcePath(ctx, "users", createdUser.Id))
+	writeMessage(w, r, status, representation.user(createdUser), createdUser)
 }
 
 func deleteUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	id := chi.URLParam(r, "id")
-	connection, err := createGrpcConnection()
+	connection, err := createGrpcConnection(ctx)
 	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("did not connect")
+		zerolog.Ctx(ctx).Error().Err(err).Msg("did not connect")
+		http.Error(w, "user service unavailable", http.StatusBadGateway)
+		return
 	}
 	defer connection.Close()
 	c := pb.NewUserServiceClient(connection)
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
 	_, err = c.DeleteUser(ctx, &pb.User{Id: id})
 	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not delete user")
+		zerolog.Ctx(ctx).Error().Err(err).Msg("could not delete user")
+		http.Error(w, err.Error(), grpcStatusToHTTP(err))
+		return
 	}
-	w.Write([]byte("User deleted"))
+	representationFromContext(ctx).deleted(w, "User deleted")
 }
 
-func createGrpcConnection() (*grpc.ClientConn, error) {
-	connection, err := grpc.NewClient(
-		getUserGrpcEndpoint(),
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+// createGrpcConnection connects to the user service, or to the target of
+// its upstream group assigned to the request.
+func createGrpcConnection(ctx context.Context) (*grpc.ClientConn, error) {
+	transportCredentials, err := getUserTransportCredentials()
+	if err != nil {
+		return nil, err
+	}
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(transportCredentials),
 		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
 		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()),
-	)
-	return connection, err
-}
-
-func getHTTPClient() *http.Client {
-	return &http.Client{
-		Transport: otelhttp.NewTransport(http.DefaultTransport),
+		grpc.WithChainUnaryInterceptor(requestIDUnaryClientInterceptor, subjectUnaryClientInterceptor, resilienceUnaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(requestIDStreamClientInterceptor, subjectStreamClientInterceptor, resilienceStreamClientInterceptor),
 	}
-}
-
-func getCompany(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	id := chi.URLParam(r, "id")
-	req, err := newHTTPRequest(ctx, "GET", fmt.Sprintf("%s/companies/%s", getCompanyHttpEndpoint(), id), nil)
-	req = req.WithContext(ctx)
+	identity, err := getServiceIdentity()
 	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not create fetch company")
+		return nil, err
 	}
-	resp, err := getHTTPClient().Do(req)
-	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not fetch company")
+	if identity != nil {
+		options = append(options, grpc.WithPerRPCCredentials(identity))
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not read resp body")
-		}
-		bodyString := string(bodyBytes)
-		w.Write([]byte(bodyString))
-	} else {
-		w.Write([]byte("Company not found"))
+	endpoint := getUserGrpcEndpoint()
+	if a := targetAssignmentFromContext(ctx); a != nil && a.kind == grpcUpstreamKind {
+		endpoint = expandTarget(a.target.Target)
 	}
+	return grpc.NewClient(endpoint, options...)
 }
 
-func newHTTPRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, url, body)
-	if err != nil {
-		return nil, err
-	}
-
-	// Very important: without this, it's impossible to propagate the trace
-	return req.WithContext(ctx), nil
+func getHTTPClient() *http.Client {
+	u, _ := getUpstreams()
+	return newUpstreamHTTPClient(u.company)
 }
 
-func getAllCompanies(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	req, err := newHTTPRequest(ctx, "GET", fmt.Sprintf("%s/companies", getCompanyHttpEndpoint()), nil)
-	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not create fetch companies")
-	}
-	req = req.WithContext(ctx)
-	resp, err := getHTTPClient().Do(req)
-	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not fetch companies")
+// newUpstreamHTTPClient returns a client calling with the policy of u, or
+// without any when nil.
+func newUpstreamHTTPClient(u *upstream) *http.Client {
+	transport := otelhttp.NewTransport(http.DefaultTransport)
+	if u == nil {
+		return &http.Client{Transport: transport}
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not read resp body")
-		}
-		bodyString := string(bodyBytes)
-		w.Write([]byte(bodyString))
-	} else {
-		w.Write([]byte("Could not fetch companies"))
+	return &http.Client{
+		// Retries are traced as separate spans
+		Transport: &resilientTransport{
+			upstream: u,
+			next:     transport,
+		},
 	}
 }
 
-func createCompany(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not read request body")
-	}
-
-	var company Company
-	err = json.Unmarshal(body, &company)
-	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not unmarshal request body")
-	}
-
-	jsonStr := string(body)
-
-	req, err := newHTTPRequest(ctx, "POST", fmt.Sprintf("%s/companies", getCompanyHttpEndpoint()), strings.NewReader(jsonStr))
-	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not create company request")
+// writeCompany replies with a company of the company service.
+func writeCompany(w http.ResponseWriter, r *http.Request, status int, data []byte) {
+	company, err := representationFromContext(r.Context()).company(data)
+	if err == nil {
+		data, err = json.Marshal(company)
 	}
-	req = req.WithContext(ctx)
-	resp, err := getHTTPClient().Do(req)
 	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not create company")
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not read resp body")
-		}
-		bodyString := string(bodyBytes)
-		w.Write([]byte(bodyString))
-	} else {
-		w.Write([]byte("Could not create company"))
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("company service replied with an invalid company")
+		http.Error(w, "company service replied with an invalid company", http.StatusBadGateway)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
 }
 
-func deleteCompany(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	id := chi.URLParam(r, "id")
-
-	req, err := newHTTPRequest(ctx, "DELETE", fmt.Sprintf("%s/companies/%s", getCompanyHttpEndpoint(), id), nil)
+func newHTTPRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
 	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not create delete request")
+		return nil, err
 	}
-	req = req.WithContext(ctx)
-	resp, err := getHTTPClient().Do(req)
-	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("could not delete company")
+	if p, ok := principalFromContext(ctx); ok {
+		req.Header.Set(subjectHeader, p.Subject)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		w.Write([]byte("Company deleted"))
-	} else {
-		w.Write([]byte("Could not delete company"))
+	if id := requestIDFromContext(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
 	}
+
+	// Very important: without this, it's impossible to propagate the trace
+	return req.WithContext(ctx), nil
 }
 
 func createNATSConnection() (*nats.Conn, error) {
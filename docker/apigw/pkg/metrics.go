@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// Port of the HTTP server exposing /metrics. When not set metrics are
+// collected but not served.
+const metricsTCPPort = "METRICS_TCP_PORT"
+
+var (
+	upstreamCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_upstream_calls_total",
+		Help: "Total number of calls to upstream services by outcome: success, failure, circuit_open or bulkhead_full.",
+	}, []string{"upstream", "outcome"})
+
+	upstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_upstream_retries_total",
+		Help: "Total number of retried calls to upstream services.",
+	}, []string{"upstream"})
+
+	upstreamRetryBudgetExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_upstream_retry_budget_exhausted_total",
+		Help: "Total number of retries skipped because the retry budget was exhausted.",
+	}, []string{"upstream"})
+
+	upstreamCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "apigw_upstream_circuit_state",
+		Help: "State of the upstream circuit breaker: 0 closed, 1 half-open, 2 open.",
+	}, []string{"upstream"})
+
+	upstreamCircuitTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_upstream_circuit_transitions_total",
+		Help: "Total number of circuit breaker state changes by new state.",
+	}, []string{"upstream", "state"})
+
+	upstreamInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "apigw_upstream_in_flight",
+		Help: "Number of calls to upstream services currently holding a bulkhead slot.",
+	}, []string{"upstream"})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_cache_requests_total",
+		Help: "Total number of requests to cached routes by result: hit, miss or coalesced.",
+	}, []string{"cache", "result"})
+
+	cacheInvalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_cache_invalidations_total",
+		Help: "Total number of cache entries invalidated by change events.",
+	}, []string{"cache"})
+
+	cacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "apigw_cache_entries",
+		Help: "Number of responses currently cached.",
+	}, []string{"cache"})
+
+	eventStreamClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "apigw_event_stream_clients",
+		Help: "Number of clients currently following the user events by transport: sse or websocket.",
+	}, []string{"transport"})
+
+	eventStreamEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_event_stream_events_total",
+		Help: "Total number of events sent to event stream clients.",
+	}, []string{"transport"})
+
+	eventStreamDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_event_stream_disconnects_total",
+		Help: "Total number of event stream clients disconnected because they failed to take events or heartbeats in time.",
+	}, []string{"transport"})
+
+	idempotencyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_idempotency_requests_total",
+		Help: "Total number of requests carrying an Idempotency-Key by result: stored, replayed, mismatch or in_progress.",
+	}, []string{"result"})
+
+	idempotencyEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "apigw_idempotency_entries",
+		Help: "Number of responses currently kept for Idempotency-Key retries.",
+	})
+
+	apiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_api_requests_total",
+		Help: "Total number of requests to the users and companies routes by API version (unversioned, v1 or v2), route without the version prefix and status code.",
+	}, []string{"version", "route", "code"})
+
+	routeReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_route_reloads_total",
+		Help: "Total number of ROUTES_CONFIG reloads by result: success or failure.",
+	}, []string{"result"})
+
+	upstreamTargetRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_upstream_target_requests_total",
+		Help: "Total number of requests to the routes calling an upstream group by group, target and status code.",
+	}, []string{"group", "target", "code"})
+
+	upstreamTargetDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "apigw_upstream_target_request_duration_seconds",
+		Help:    "Duration of the requests to the routes calling an upstream group by group and target.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"group", "target"})
+
+	mirrorRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_mirror_requests_total",
+		Help: "Total number of requests copied to shadow upstreams by route and result: mirrored, failed or dropped when too many copies are in flight.",
+	}, []string{"route", "result"})
+
+	mirrorDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "apigw_mirror_request_duration_seconds",
+		Help:    "Duration of the calls to shadow upstreams by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	mirrorMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_mirror_mismatches_total",
+		Help: "Total number of shadow responses differing from the primary ones by route and kind: status or body.",
+	}, []string{"route", "kind"})
+
+	faultsInjected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_faults_injected_total",
+		Help: "Total number of faults injected in the requests by action: delay, status or drop.",
+	}, []string{"action"})
+
+	trafficRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apigw_traffic_records_total",
+		Help: "Total number of requests written to TRAFFIC_RECORD_FILE by result: recorded, or dropped when the file cannot keep up.",
+	}, []string{"result"})
+)
+
+// startMetricsServer serves the Prometheus metrics on METRICS_TCP_PORT.
+func startMetricsServer() {
+	port, exists := os.LookupEnv(metricsTCPPort)
+	if !exists {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Printf("Metrics server listening on port %s", port)
+		if err := http.ListenAndServe(fmt.Sprintf(":%s", port), mux); err != nil {
+			log.Error().Err(err).Msg("metrics server stopped")
+		}
+	}()
+}
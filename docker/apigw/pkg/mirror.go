@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultMirrorTimeout     = 5 * time.Second
+	defaultMirrorMaxInFlight = 100
+	// Bytes of the primary and shadow responses kept for diffing, longer
+	// bodies are only compared by status.
+	mirrorDiffLimit = 1 << 20
+	// Differing fields logged per mismatch.
+	mirrorDiffFields = 10
+)
+
+// routeMirror copies the requests of a REST route to a shadow upstream,
+// e.g. a rewrite of the service under test. Its responses are discarded,
+// and the primary response never waits for them.
+type routeMirror struct {
+	// Base URL of the shadow upstream, ${VAR} is replaced by the
+	// environment variable VAR on each call.
+	Target string `json:"target"`
+	// Percentage of the requests copied, all of them when not set. 0
+	// stops the copies.
+	Percent *float64 `json:"percent"`
+	// Deadline of the copies, 5s by default.
+	Timeout duration `json:"timeout"`
+	// Copies in flight beyond which requests are not copied, 100 by
+	// default.
+	MaxInFlight int `json:"max_in_flight"`
+	// Compare the status and the body of the shadow responses with the
+	// primary ones.
+	Diff bool `json:"diff"`
+	// JSON fields left out of the comparison at any depth, e.g. generated
+	// ids and timestamps.
+	IgnoreFields []string `json:"ignore_fields"`
+
+	inFlight chan struct{}
+	client   *http.Client
+}
+
+func (m *routeMirror) validate() error {
+	if m.Target == "" {
+		return fmt.Errorf("mirror has no target")
+	}
+	if err := checkTarget(m.Target); err != nil {
+		return fmt.Errorf("mirror target: %w", err)
+	}
+	if m.Percent != nil && (*m.Percent < 0 || *m.Percent > 100) {
+		return fmt.Errorf("mirror percent must be between 0 and 100")
+	}
+	if m.Timeout < 0 || m.MaxInFlight < 0 {
+		return fmt.Errorf("mirror timeout and max_in_flight must not be negative")
+	}
+	if m.Timeout == 0 {
+		m.Timeout = duration(defaultMirrorTimeout)
+	}
+	if m.MaxInFlight == 0 {
+		m.MaxInFlight = defaultMirrorMaxInFlight
+	}
+	m.inFlight = make(chan struct{}, m.MaxInFlight)
+	// Shadow failures must not count against the policy of the primary.
+	m.client = newUpstreamHTTPClient(nil)
+	return nil
+}
+
+// mirroredResponse is a response of the primary or of the shadow upstream.
+type mirroredResponse struct {
+	status int
+	body   *limitedBuffer
+}
+
+// mirrorCopy hands the primary response over to the copy of a request that
+// has to be diffed.
+type mirrorCopy struct {
+	primary chan *mirroredResponse
+	body    *limitedBuffer
+}
+
+// capture keeps the body of the primary response as it is read.
+func (c *mirrorCopy) capture(resp *http.Response) {
+	if c == nil {
+		return
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, c.body), resp.Body}
+}
+
+// finish hands the primary response over, status 0 if there was none.
+func (c *mirrorCopy) finish(status int) {
+	if c == nil {
+		return
+	}
+	c.primary <- &mirroredResponse{status: status, body: c.body}
+}
+
+// start copies a request to the shadow upstream. uri is the path and query
+// of the primary call. The returned copy is nil unless the responses are
+// diffed.
+func (m *routeMirror) start(ctx context.Context, route, method, uri string, header http.Header, body []byte) *mirrorCopy {
+	if m == nil || (m.Percent != nil && rand.Float64()*100 >= *m.Percent) {
+		return nil
+	}
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		mirrorRequests.WithLabelValues(route, "dropped").Inc()
+		return nil
+	}
+	var c *mirrorCopy
+	if m.Diff {
+		c = &mirrorCopy{primary: make(chan *mirroredResponse, 1), body: &limitedBuffer{limit: mirrorDiffLimit}}
+	}
+	header = header.Clone()
+	go func() {
+		defer func() { <-m.inFlight }()
+		// The copy outlives the request, keeping its trace and logger.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Duration(m.Timeout))
+		defer cancel()
+		logger := zerolog.Ctx(ctx)
+
+		shadow, err := m.call(ctx, route, method, uri, header, body)
+		if err != nil {
+			mirrorRequests.WithLabelValues(route, "failed").Inc()
+			logger.Warn().Err(err).Str("route", route).Msg("mirrored request failed")
+			return
+		}
+		mirrorRequests.WithLabelValues(route, "mirrored").Inc()
+		if c == nil {
+			return
+		}
+		var primary *mirroredResponse
+		select {
+		case primary = <-c.primary:
+		case <-ctx.Done():
+		}
+		if primary == nil || primary.status == 0 {
+			return
+		}
+		m.compare(logger, route, primary, shadow)
+	}()
+	return c
+}
+
+func (m *routeMirror) call(ctx context.Context, route, method, uri string, header http.Header, body []byte) (*mirroredResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, method, expandTarget(m.Target)+uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	start := time.Now()
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res := &mirroredResponse{status: resp.StatusCode}
+	if m.Diff {
+		res.body = &limitedBuffer{limit: mirrorDiffLimit}
+		_, err = io.Copy(res.body, resp.Body)
+	} else {
+		_, err = io.Copy(io.Discard, resp.Body)
+	}
+	mirrorDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	return res, err
+}
+
+// compare records the differences between the primary and the shadow
+// responses. Bodies are compared as JSON when both are, byte by byte
+// otherwise, and only when both responses are successful with the same
+// status.
+func (m *routeMirror) compare(logger *zerolog.Logger, route string, primary, shadow *mirroredResponse) {
+	if primary.status != shadow.status {
+		mirrorMismatches.WithLabelValues(route, "status").Inc()
+		logger.Warn().Str("route", route).Int("primary_status", primary.status).Int("shadow_status", shadow.status).
+			Msg("mirrored response status differs")
+		return
+	}
+	if primary.status >= 300 || primary.body.truncated || shadow.body.truncated {
+		return
+	}
+	var primaryJSON, shadowJSON any
+	if json.Unmarshal(primary.body.Bytes(), &primaryJSON) != nil || json.Unmarshal(shadow.body.Bytes(), &shadowJSON) != nil {
+		if !bytes.Equal(primary.body.Bytes(), shadow.body.Bytes()) {
+			mirrorMismatches.WithLabelValues(route, "body").Inc()
+			logger.Warn().Str("route", route).Int("status", primary.status).Msg("mirrored response body differs")
+		}
+		return
+	}
+	var fields []string
+	diffJSON(primaryJSON, shadowJSON, "", m.IgnoreFields, &fields)
+	if len(fields) > 0 {
+		mirrorMismatches.WithLabelValues(route, "body").Inc()
+		logger.Warn().Str("route", route).Int("status", primary.status).Strs("fields", fields).
+			Msg("mirrored response body differs")
+	}
+}
+
+// diffJSON appends to fields the paths, e.g. members[2].name, at which two
+// JSON values differ, up to mirrorDiffFields of them.
+func diffJSON(a, b any, path string, ignore []string, fields *[]string) {
+	if len(*fields) >= mirrorDiffFields {
+		return
+	}
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(a)+len(b))
+		for key := range a {
+			keys = append(keys, key)
+		}
+		for key := range b {
+			if _, ok := a[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if slices.Contains(ignore, key) {
+				continue
+			}
+			field := key
+			if path != "" {
+				field = path + "." + key
+			}
+			diffJSON(a[key], b[key], field, ignore, fields)
+		}
+		return
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			break
+		}
+		for i := range a {
+			diffJSON(a[i], b[i], path+"["+strconv.Itoa(i)+"]", ignore, fields)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		if path == "" {
+			path = "."
+		}
+		*fields = append(*fields, path)
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.truncated = true
+		b.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
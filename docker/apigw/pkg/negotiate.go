@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+// qualityValue is an entry of an Accept or Accept-Encoding header.
+type qualityValue struct {
+	value string
+	q     float64
+}
+
+func parseQualityValues(header string) []qualityValue {
+	var res []qualityValue
+	for _, entry := range strings.Split(header, ",") {
+		value, params, _ := strings.Cut(entry, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		res = append(res, qualityValue{value, q})
+	}
+	return res
+}
+
+// mediaRangeSpecificity tells how closely a media range matches a media
+// type: 3 for the type itself, 2 for type/*, 1 for */* and 0 for no match.
+func mediaRangeSpecificity(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 3
+	case mediaRange == "*/*":
+		return 1
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+		return 2
+	}
+	return 0
+}
+
+// codingSpecificity is mediaRangeSpecificity for content codings.
+func codingSpecificity(coding, offer string) int {
+	switch coding {
+	case offer:
+		return 2
+	case "*":
+		return 1
+	}
+	return 0
+}
+
+// negotiate returns the offer the header prefers, offers being listed by
+// the server's preference, or "" when the header accepts none of them. The
+// first offer is returned when there is no header.
+func negotiate(header string, offers []string, specificity func(value, offer string) int) string {
+	if strings.TrimSpace(header) == "" {
+		return offers[0]
+	}
+	values := parseQualityValues(header)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		// The most specific matching value sets the quality of an offer.
+		q, matched := 0.0, 0
+		for _, v := range values {
+			if s := specificity(v.value, offer); s > matched {
+				q, matched = v.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+func negotiateContentType(r *http.Request, offers ...string) string {
+	return negotiate(r.Header.Get("Accept"), offers, mediaRangeSpecificity)
+}
+
+// prefersJSON tells whether r gets JSON out of the routes that negotiate
+// their representation.
+func prefersJSON(r *http.Request) bool {
+	return negotiateContentType(r, contentTypeJSON, contentTypeProtobuf, contentTypeNDJSON) == contentTypeJSON
+}
+
+func notAcceptable(w http.ResponseWriter, offers ...string) {
+	http.Error(w, fmt.Sprintf("not acceptable, available representations are %s", strings.Join(offers, ", ")), http.StatusNotAcceptable)
+}
+
+// writeMessage replies with body as JSON or, when the client asks for it,
+// with msg as binary protobuf.
+func writeMessage(w http.ResponseWriter, r *http.Request, status int, body any, msg proto.Message) {
+	offers := []string{contentTypeJSON, contentTypeProtobuf}
+	w.Header().Add("Vary", "Accept")
+	var data []byte
+	var err error
+	contentType := negotiateContentType(r, offers...)
+	switch contentType {
+	case contentTypeJSON:
+		data, err = json.Marshal(body)
+	case contentTypeProtobuf:
+		data, err = proto.Marshal(msg)
+	default:
+		notAcceptable(w, offers...)
+		return
+	}
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("could not marshal response")
+		http.Error(w, "could not marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// writeList replies with a list as JSON or, when the client asks for it, as
+// NDJSON with an item per line. msg, when not nil, is the list as protobuf;
+// items is what the NDJSON lines are made of.
+func writeList[T any](w http.ResponseWriter, r *http.Request, body any, msg proto.Message, items []T) {
+	offers := []string{contentTypeJSON, contentTypeNDJSON}
+	if msg != nil {
+		offers = append(offers, contentTypeProtobuf)
+	}
+	w.Header().Add("Vary", "Accept")
+	var buf bytes.Buffer
+	var err error
+	contentType := negotiateContentType(r, offers...)
+	switch contentType {
+	case contentTypeJSON:
+		var data []byte
+		data, err = json.Marshal(body)
+		buf.Write(data)
+	case contentTypeNDJSON:
+		encoder := json.NewEncoder(&buf)
+		for _, item := range items {
+			if err = encoder.Encode(item); err != nil {
+				break
+			}
+		}
+	case contentTypeProtobuf:
+		var data []byte
+		data, err = proto.Marshal(msg)
+		buf.Write(data)
+	default:
+		notAcceptable(w, offers...)
+		return
+	}
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("could not marshal response")
+		http.Error(w, "could not marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf.Bytes())
+}
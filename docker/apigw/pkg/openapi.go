@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// openAPISpec describes the unversioned and v1 routes of the gateway, and
+// openAPISpecV2 the v2 ones. Each version serves its document at
+// openapi.json and requests are validated against them.
+var (
+	//go:embed openapi.json
+	openAPISpec []byte
+	//go:embed openapi_v2.json
+	openAPISpecV2 []byte
+)
+
+// openAPISpecs lists the documents with the URL their schemas are compiled
+// under.
+var openAPISpecs = []struct {
+	url  string
+	spec []byte
+}{
+	{"openapi.json", openAPISpec},
+	{"openapi_v2.json", openAPISpecV2},
+}
+
+// JSON bodies larger than this are rejected without being validated.
+const maxValidatedBodySize = 1 << 20
+
+var validationPrinter = message.NewPrinter(language.English)
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIDocument struct {
+	Servers    []openAPIServer                       `json:"servers"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Parameters map[string]openAPIParameter `json:"parameters"`
+	} `json:"components"`
+}
+
+type openAPIParameter struct {
+	Ref      string `json:"$ref"`
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+}
+
+type openAPIOperation struct {
+	Parameters  []openAPIParameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool                       `json:"required"`
+		Content  map[string]json.RawMessage `json:"content"`
+	} `json:"requestBody"`
+}
+
+type parameterValidator struct {
+	name     string
+	in       string
+	required bool
+	schema   *jsonschema.Schema
+}
+
+// operationValidator checks the requests of a single operation. Only JSON
+// bodies are validated, the other accepted media types are streamed to the
+// handler as they are.
+type operationValidator struct {
+	parameters   []parameterValidator
+	bodyRequired bool
+	mediaTypes   []string
+	bodySchema   *jsonschema.Schema
+}
+
+// requestValidator rejects the requests that do not match openAPISpecs.
+type requestValidator struct {
+	// Keyed by method and route pattern, e.g. "GET /users/{id}".
+	operations map[string]*operationValidator
+}
+
+// escapePointer escapes a JSON pointer token.
+func escapePointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
+
+// isOpenAPIOperation tells whether a field of a path item is an operation.
+func isOpenAPIOperation(field string) bool {
+	switch field {
+	case "parameters", "summary", "description", "servers":
+		return false
+	}
+	return true
+}
+
+// routes returns the paths a path item is served at: path under each of
+// the servers of the item or, by default, of the document.
+func (doc *openAPIDocument) routes(path string, item map[string]json.RawMessage) ([]string, error) {
+	servers := doc.Servers
+	if data, ok := item["servers"]; ok {
+		var own []openAPIServer
+		if err := json.Unmarshal(data, &own); err != nil {
+			return nil, fmt.Errorf("invalid servers of %s: %w", path, err)
+		}
+		servers = own
+	}
+	if len(servers) == 0 {
+		return []string{path}, nil
+	}
+	routes := make([]string, len(servers))
+	for i, server := range servers {
+		routes[i] = strings.TrimSuffix(server.URL, "/") + path
+	}
+	return routes, nil
+}
+
+// newRequestValidator compiles the schemas of openAPISpecs.
+func newRequestValidator() (*requestValidator, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.DefaultDraft(jsonschema.Draft2020)
+	v := &requestValidator{operations: make(map[string]*operationValidator)}
+	for _, s := range openAPISpecs {
+		if err := v.addDocument(compiler, s.url, s.spec); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.url, err)
+		}
+	}
+	return v, nil
+}
+
+// addDocument adds the operations of the document spec, compiling its
+// schemas under url.
+func (v *requestValidator) addDocument(compiler *jsonschema.Compiler, url string, spec []byte) error {
+	var doc openAPIDocument
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+	raw, err := jsonschema.UnmarshalJSON(bytes.NewReader(spec))
+	if err != nil {
+		return fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+	if err := compiler.AddResource(url, raw); err != nil {
+		return err
+	}
+	compile := func(pointer string) (*jsonschema.Schema, error) {
+		schema, err := compiler.Compile(url + "#" + pointer)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile %s: %w", pointer, err)
+		}
+		return schema, nil
+	}
+	// resolve returns a parameter and the pointer to its schema.
+	resolve := func(p openAPIParameter, pointer string) (openAPIParameter, string, error) {
+		if p.Ref == "" {
+			return p, pointer + "/schema", nil
+		}
+		name, found := strings.CutPrefix(p.Ref, "#/components/parameters/")
+		resolved, exists := doc.Components.Parameters[name]
+		if !found || !exists {
+			return p, "", fmt.Errorf("unknown parameter %s", p.Ref)
+		}
+		return resolved, "/components/parameters/" + escapePointer(name) + "/schema", nil
+	}
+
+	for path, item := range doc.Paths {
+		pathPointer := "/paths/" + escapePointer(path)
+		routes, err := doc.routes(path, item)
+		if err != nil {
+			return err
+		}
+		var common []openAPIParameter
+		if data, ok := item["parameters"]; ok {
+			if err := json.Unmarshal(data, &common); err != nil {
+				return fmt.Errorf("invalid parameters of %s: %w", path, err)
+			}
+		}
+		for method, data := range item {
+			if !isOpenAPIOperation(method) {
+				continue
+			}
+			var op openAPIOperation
+			if err := json.Unmarshal(data, &op); err != nil {
+				return fmt.Errorf("invalid operation %s %s: %w", method, path, err)
+			}
+			opPointer := pathPointer + "/" + method
+			ov := &operationValidator{}
+
+			pointers := make([]string, 0, len(common)+len(op.Parameters))
+			params := append(slices.Clone(common), op.Parameters...)
+			for i := range common {
+				pointers = append(pointers, fmt.Sprintf("%s/parameters/%d", pathPointer, i))
+			}
+			for i := range op.Parameters {
+				pointers = append(pointers, fmt.Sprintf("%s/parameters/%d", opPointer, i))
+			}
+			for i, p := range params {
+				p, schemaPointer, err := resolve(p, pointers[i])
+				if err != nil {
+					return fmt.Errorf("%s %s: %w", method, path, err)
+				}
+				schema, err := compile(schemaPointer)
+				if err != nil {
+					return err
+				}
+				ov.parameters = append(ov.parameters, parameterValidator{name: p.Name, in: p.In, required: p.Required, schema: schema})
+			}
+
+			if op.RequestBody != nil {
+				ov.bodyRequired = op.RequestBody.Required
+				for mediaType := range op.RequestBody.Content {
+					ov.mediaTypes = append(ov.mediaTypes, mediaType)
+				}
+				sort.Strings(ov.mediaTypes)
+				if _, ok := op.RequestBody.Content["application/json"]; ok {
+					ov.bodySchema, err = compile(opPointer + "/requestBody/content/application~1json/schema")
+					if err != nil {
+						return err
+					}
+				}
+			}
+			for _, route := range routes {
+				v.operations[strings.ToUpper(method)+" "+route] = ov
+			}
+		}
+	}
+	return nil
+}
+
+// describeValidationError lists the failures of err, one per invalid
+// location, e.g. "/name: maxLength: got 300, want 256".
+func describeValidationError(err error) string {
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return err.Error()
+	}
+	var problems []string
+	var walk func(e *jsonschema.ValidationError)
+	walk = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			problem := e.ErrorKind.LocalizedString(validationPrinter)
+			if len(e.InstanceLocation) > 0 {
+				problem = "/" + strings.Join(e.InstanceLocation, "/") + ": " + problem
+			}
+			problems = append(problems, problem)
+		}
+		for _, cause := range e.Causes {
+			walk(cause)
+		}
+	}
+	walk(verr)
+	return strings.Join(problems, "; ")
+}
+
+// parameterValue converts the values of a path, query or header parameter
+// to the JSON value its schema expects: an array of every value for array
+// schemas, the first value otherwise. Values that cannot be converted are
+// left as strings, so that the schema reports them.
+func parameterValue(schema *jsonschema.Schema, values []string) any {
+	for schema.Types == nil && schema.Ref != nil {
+		schema = schema.Ref
+	}
+	if schema.Types == nil {
+		return values[0]
+	}
+	types := schema.Types.ToStrings()
+	if slices.Contains(types, "array") {
+		items := make([]any, 0, len(values))
+		for _, value := range values {
+			if schema.Items2020 != nil {
+				items = append(items, parameterValue(schema.Items2020, []string{value}))
+			} else {
+				items = append(items, value)
+			}
+		}
+		return items
+	}
+	if slices.Contains(types, "string") {
+		return values[0]
+	}
+	if slices.Contains(types, "integer") || slices.Contains(types, "number") || slices.Contains(types, "boolean") {
+		if v, err := jsonschema.UnmarshalJSON(strings.NewReader(values[0])); err == nil {
+			return v
+		}
+	}
+	return values[0]
+}
+
+// validate returns the status and the description of the first problem
+// found with r, replacing its body with a copy when it was read.
+func (ov *operationValidator) validate(r *http.Request) (int, string) {
+	query := r.URL.Query()
+	for _, p := range ov.parameters {
+		var values []string
+		switch p.in {
+		case "path":
+			if value := chi.URLParam(r, p.name); value != "" {
+				values = []string{value}
+			}
+		case "query":
+			values = query[p.name]
+		case "header":
+			if value := r.Header.Get(p.name); value != "" {
+				values = []string{value}
+			}
+		default:
+			continue
+		}
+		if len(values) == 0 {
+			if p.required {
+				return http.StatusBadRequest, fmt.Sprintf("missing required %s parameter %s", p.in, p.name)
+			}
+			continue
+		}
+		if err := p.schema.Validate(parameterValue(p.schema, values)); err != nil {
+			return http.StatusBadRequest, fmt.Sprintf("invalid %s parameter %s: %s", p.in, p.name, describeValidationError(err))
+		}
+	}
+
+	if ov.mediaTypes == nil {
+		return 0, ""
+	}
+	if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+		if ov.bodyRequired {
+			return http.StatusBadRequest, "missing request body"
+		}
+		return 0, ""
+	}
+	mediaType := "application/json"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return http.StatusBadRequest, fmt.Sprintf("invalid Content-Type: %s", err)
+		}
+	} else if ov.bodySchema == nil {
+		// Handlers streaming their body pick their own default.
+		return 0, ""
+	}
+	if !slices.Contains(ov.mediaTypes, mediaType) {
+		return http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content type %s, expected one of %s", mediaType, strings.Join(ov.mediaTypes, ", "))
+	}
+	if mediaType != "application/json" || ov.bodySchema == nil {
+		return 0, ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxValidatedBodySize+1))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit)
+	}
+	if err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("could not read request body: %s", err)
+	}
+	if len(body) > maxValidatedBodySize {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is larger than %d bytes", maxValidatedBodySize)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	value, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("request body is not valid JSON: %s", err)
+	}
+	if err := ov.bodySchema.Validate(value); err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", describeValidationError(err))
+	}
+	return 0, ""
+}
+
+// Middleware rejects the requests that do not match the operation of their
+// route. It has to run once the route is matched, routes that are not in
+// the document are let through.
+func (v *requestValidator) Middleware(next http.Handler) http.Handler {
+	if v == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, ok := v.operations[r.Method+" "+chi.RouteContext(r.Context()).RoutePattern()]
+		if ok {
+			if status, problem := op.validate(r); status != 0 {
+				http.Error(w, problem, status)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveOpenAPI serves GET /openapi.json, the document of the version
+// serving the request.
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(apiVersionFromContext(r.Context()).spec)
+}
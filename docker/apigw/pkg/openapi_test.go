@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	documented := make(map[string]bool)
+	for _, s := range openAPISpecs {
+		var doc openAPIDocument
+		if err := json.Unmarshal(s.spec, &doc); err != nil {
+			t.Fatalf("invalid OpenAPI document %s: %v", s.url, err)
+		}
+		for path, item := range doc.Paths {
+			routes, err := doc.routes(path, item)
+			if err != nil {
+				t.Fatalf("%s: %v", s.url, err)
+			}
+			for method := range item {
+				if !isOpenAPIOperation(method) {
+					continue
+				}
+				for _, route := range routes {
+					documented[strings.ToUpper(method)+" "+route] = true
+				}
+			}
+		}
+	}
+
+	// The upstream targets refer to them.
+	t.Setenv("REST_COMPANY_HOST", "company")
+	t.Setenv("REST_COMPANY_PORT", "8080")
+	t.Setenv("NATS_CREATE_USER_SUBJECT", "users.create")
+	routes, err := parseRoutesConfig(defaultRoutesConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := make(map[string]bool)
+	router := newRouter(routes, nil, nil, &responseCaches{}, nil, nil, nil, nil, nil)
+	err = chi.Walk(router, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		registered[method+" "+route] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for route := range registered {
+		if !documented[route] {
+			t.Errorf("%s is registered but missing from the OpenAPI documents", route)
+		}
+	}
+	for route := range documented {
+		if !registered[route] {
+			t.Errorf("%s is in the OpenAPI documents but not registered", route)
+		}
+	}
+}
+
+func TestOpenAPISchemasCompile(t *testing.T) {
+	if _, err := newRequestValidator(); err != nil {
+		t.Fatal(err)
+	}
+}
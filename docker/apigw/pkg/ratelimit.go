@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+// Path of the JSON rate limiting configuration, see rateLimitConfig. When
+// not set requests are not limited.
+const rateLimitConfigFile = "RATE_LIMIT_CONFIG"
+
+const (
+	// Idle buckets are dropped after this long; by then they are full again
+	// anyway, unless the rate is very low.
+	rateLimitIdleTimeout = 10 * time.Minute
+	// Attempts at updating a shared bucket before falling back to the local
+	// one.
+	rateLimitMaxConflicts = 5
+)
+
+type rateLimit struct {
+	// Tokens added per second.
+	Rate float64 `json:"rate"`
+	// Bucket size, i.e. the largest burst allowed.
+	Burst float64 `json:"burst"`
+}
+
+type routeRateLimit struct {
+	Method  string `json:"method"`
+	Pattern string `json:"pattern"`
+	rateLimit
+}
+
+// rateLimitConfig is the content of RATE_LIMIT_CONFIG, e.g.
+//
+//	{
+//	  "keys": ["api_key", "subject", "ip"],
+//	  "default": {"rate": 10, "burst": 20},
+//	  "routes": [
+//	    {"method": "POST", "pattern": "/users/import", "rate": 0.01, "burst": 1}
+//	  ],
+//	  "distributed": {"bucket": "apigw_rate_limits"}
+//	}
+//
+// Clients are identified by the first of keys they have: the API key
+// header, the JWT subject or the client IP. Each route listed in routes has
+// its own bucket per client, all the other routes share the default one.
+// Patterns have no version prefix: a route shares its bucket across the
+// API versions.
+type rateLimitConfig struct {
+	Keys           []string         `json:"keys"`
+	APIKeyHeader   string           `json:"api_key_header"`
+	ClientIPHeader string           `json:"client_ip_header"`
+	Default        rateLimit        `json:"default"`
+	Routes         []routeRateLimit `json:"routes"`
+	// When set, buckets are shared by all the gateway replicas through this
+	// JetStream key-value bucket.
+	Distributed *struct {
+		Bucket string `json:"bucket"`
+	} `json:"distributed"`
+}
+
+// tokenBucket is the state of a bucket, persisted as is in distributed mode.
+type tokenBucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// take refills the bucket up to now and takes a token if there is one.
+func (b *tokenBucket) take(limit rateLimit, now time.Time) bool {
+	if b.Updated.IsZero() {
+		b.Tokens = limit.Burst
+	} else if elapsed := now.Sub(b.Updated).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(limit.Burst, b.Tokens+elapsed*limit.Rate)
+	}
+	b.Updated = now
+	if b.Tokens < 1 {
+		return false
+	}
+	b.Tokens--
+	return true
+}
+
+type rateLimiter struct {
+	config rateLimitConfig
+	routes map[string]rateLimit
+	kv     nats.KeyValue
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter loads RATE_LIMIT_CONFIG. It returns nil when rate limiting
+// is disabled.
+func newRateLimiter() (*rateLimiter, error) {
+	path, exists := os.LookupEnv(rateLimitConfigFile)
+	if !exists {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", rateLimitConfigFile, err)
+	}
+	var config rateLimitConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", rateLimitConfigFile, err)
+	}
+	if len(config.Keys) == 0 {
+		config.Keys = []string{"api_key", "subject", "ip"}
+	}
+	for _, key := range config.Keys {
+		if key != "api_key" && key != "subject" && key != "ip" {
+			return nil, fmt.Errorf("unknown rate limiting key %q", key)
+		}
+	}
+	if config.APIKeyHeader == "" {
+		config.APIKeyHeader = "X-API-Key"
+	}
+
+	l := &rateLimiter{
+		config:  config,
+		routes:  make(map[string]rateLimit),
+		buckets: make(map[string]*tokenBucket),
+	}
+	for _, route := range append(config.Routes, routeRateLimit{Pattern: "*", rateLimit: config.Default}) {
+		if route.Rate <= 0 || route.Burst < 1 {
+			return nil, fmt.Errorf("rate limit of %s %s needs a positive rate and a burst of at least 1", route.Method, route.Pattern)
+		}
+		l.routes[strings.ToUpper(route.Method)+" "+route.Pattern] = route.rateLimit
+	}
+
+	if config.Distributed != nil {
+		conn, err := createNATSConnection()
+		if err != nil {
+			return nil, fmt.Errorf("could not create NATS connection: %w", err)
+		}
+		js, err := conn.JetStream()
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to JetStream: %w", err)
+		}
+		l.kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket: config.Distributed.Bucket,
+			TTL:    rateLimitIdleTimeout,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not create key-value bucket %s: %w", config.Distributed.Bucket, err)
+		}
+	}
+	// Local buckets are also the fallback of the shared ones.
+	go l.evictIdleBuckets()
+	return l, nil
+}
+
+func (l *rateLimiter) evictIdleBuckets() {
+	for range time.Tick(rateLimitIdleTimeout) {
+		l.mu.Lock()
+		for key, bucket := range l.buckets {
+			if time.Since(bucket.Updated) > rateLimitIdleTimeout {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// clientKey identifies the client making the request.
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	for _, key := range l.config.Keys {
+		switch key {
+		case "api_key":
+			if apiKey := r.Header.Get(l.config.APIKeyHeader); apiKey != "" {
+				// API keys are secrets, do not keep them around in clear.
+				sum := sha256.Sum256([]byte(apiKey))
+				return "key:" + hex.EncodeToString(sum[:8])
+			}
+		case "subject":
+			if p, ok := principalFromContext(r.Context()); ok {
+				return "sub:" + p.Subject
+			}
+		case "ip":
+			return "ip:" + clientIP(r, l.config.ClientIPHeader)
+		}
+	}
+	return "anonymous"
+}
+
+// clientIP returns the first address in header, when set and present, or
+// the address of the connection.
+func clientIP(r *http.Request, header string) string {
+	if header != "" {
+		if value := r.Header.Get(header); value != "" {
+			ip, _, _ := strings.Cut(value, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (l *rateLimiter) takeLocal(key string, limit rateLimit, now time.Time) (tokenBucket, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{}
+		l.buckets[key] = bucket
+	}
+	allowed := bucket.take(limit, now)
+	return *bucket, allowed
+}
+
+// takeShared updates the bucket in the key-value store with optimistic
+// concurrency control.
+func (l *rateLimiter) takeShared(key string, limit rateLimit, now time.Time) (tokenBucket, bool, error) {
+	sum := sha256.Sum256([]byte(key))
+	kvKey := hex.EncodeToString(sum[:16])
+	for attempt := 0; attempt < rateLimitMaxConflicts; attempt++ {
+		var bucket tokenBucket
+		var revision uint64
+		entry, err := l.kv.Get(kvKey)
+		switch {
+		case errors.Is(err, nats.ErrKeyNotFound):
+		case err != nil:
+			return bucket, false, err
+		default:
+			if err := json.Unmarshal(entry.Value(), &bucket); err != nil {
+				return bucket, false, err
+			}
+			revision = entry.Revision()
+		}
+		allowed := bucket.take(limit, now)
+		data, _ := json.Marshal(bucket)
+		if revision == 0 {
+			_, err = l.kv.Create(kvKey, data)
+		} else {
+			_, err = l.kv.Update(kvKey, data, revision)
+		}
+		if err == nil {
+			return bucket, allowed, nil
+		}
+	}
+	return tokenBucket{}, false, errors.New("too many conflicting updates")
+}
+
+// Middleware enforces the rate limits. It must be installed where the route
+// pattern is already known, i.e. in a Group or With.
+func (l *rateLimiter) Middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Method + " " + routePattern(r)
+		limit, ok := l.routes[route]
+		if !ok {
+			route = " *"
+			limit = l.routes[route]
+		}
+		key := l.clientKey(r) + "|" + route
+		now := time.Now()
+
+		var bucket tokenBucket
+		var allowed bool
+		if l.kv != nil {
+			var err error
+			bucket, allowed, err = l.takeShared(key, limit, now)
+			if err != nil {
+				zerolog.Ctx(r.Context()).Error().Err(err).Msg("could not update shared rate limit, using the local one")
+				bucket, allowed = l.takeLocal(key, limit, now)
+			}
+		} else {
+			bucket, allowed = l.takeLocal(key, limit, now)
+		}
+
+		setRateLimitHeaders(w, limit, bucket)
+		if !allowed {
+			retryAfter := math.Ceil((1 - bucket.Tokens) / limit.Rate)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, retryAfter))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setRateLimitHeaders sets the RateLimit-* headers of the IETF draft.
+func setRateLimitHeaders(w http.ResponseWriter, limit rateLimit, bucket tokenBucket) {
+	reset := math.Ceil((limit.Burst - bucket.Tokens) / limit.Rate)
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(int(limit.Burst)))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(math.Max(0, math.Floor(bucket.Tokens)))))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(reset)))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", int(limit.Burst), int(math.Ceil(limit.Burst/limit.Rate))))
+}
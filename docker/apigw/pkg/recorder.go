@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/fcracker79/k8s-experiment/docker/rest/apigw/traffic"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+// File the traffic is recorded to, for the replay command. It is
+// overwritten on start; when not set the traffic is not recorded.
+const trafficRecordFile = "TRAFFIC_RECORD_FILE"
+
+const (
+	// Bytes of the request bodies kept in the recording.
+	maxRecordedBody = 64 << 10
+	// Records waiting to be written beyond which requests are not
+	// recorded.
+	trafficRecordQueue = 1024
+	// The recording is readable up to the requests of this long ago.
+	trafficRecordFlushInterval = time.Second
+)
+
+// Request headers kept in the recording. Credentials are left out, the
+// replay command sends its own.
+var recordedHeaders = []string{"Accept", "Content-Type", idempotencyKeyHeader, canaryHeader, "If-None-Match"}
+
+// trafficRecorder writes the requests served by the gateway, with the
+// status and the latency of their responses, to TRAFFIC_RECORD_FILE.
+type trafficRecorder struct {
+	started time.Time
+	records chan *traffic.Record
+}
+
+// newTrafficRecorder starts recording to TRAFFIC_RECORD_FILE, returning nil
+// when it is not set.
+func newTrafficRecorder() (*trafficRecorder, error) {
+	path, exists := os.LookupEnv(trafficRecordFile)
+	if !exists {
+		return nil, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s: %w", trafficRecordFile, err)
+	}
+	t := &trafficRecorder{started: time.Now(), records: make(chan *traffic.Record, trafficRecordQueue)}
+	writer, err := traffic.NewWriter(file, t.started)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not write %s: %w", trafficRecordFile, err)
+	}
+	go t.write(writer)
+	log.Info().Msgf("Recording the traffic to %s", path)
+	return t, nil
+}
+
+func (t *trafficRecorder) write(writer *traffic.Writer) {
+	ticker := time.NewTicker(trafficRecordFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case record := <-t.records:
+			if err := writer.Write(record); err != nil {
+				log.Error().Err(err).Msg("could not record a request")
+			}
+		case <-ticker.C:
+			if err := writer.Flush(); err != nil {
+				log.Error().Err(err).Msg("could not flush the traffic recording")
+			}
+		}
+	}
+}
+
+// Middleware records the requests with the pattern of their route, so that
+// the replay command knows the parameters of the paths.
+func (t *trafficRecorder) Middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		record := &traffic.Record{
+			Offset: start.Sub(t.started),
+			Method: r.Method,
+			URI:    r.URL.RequestURI(),
+		}
+		for _, name := range recordedHeaders {
+			if value := r.Header.Get(name); value != "" {
+				if record.Header == nil {
+					record.Header = make(map[string]string)
+				}
+				record.Header[name] = value
+			}
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			// The handler reads what was recorded, then the rest.
+			read, _ := io.ReadAll(io.LimitReader(r.Body, maxRecordedBody+1))
+			record.Body, record.Truncated = read, len(read) > maxRecordedBody
+			if record.Truncated {
+				record.Body = read[:maxRecordedBody]
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(read), r.Body), r.Body}
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		// The pattern is complete once the sub-routers matched.
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			record.Route = rctx.RoutePattern()
+		}
+		record.Status = ww.Status()
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		record.Duration = time.Since(start)
+
+		select {
+		case t.records <- record:
+			trafficRecords.WithLabelValues("recorded").Inc()
+		default:
+			trafficRecords.WithLabelValues("dropped").Inc()
+		}
+	})
+}
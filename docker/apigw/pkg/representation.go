@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	pb "github.com/fcracker79/k8s-experiment/docker/rest/apigw/proto/user"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// representation is how an API version exposes users and companies.
+// Handlers work with the messages of the user service and the JSON of the
+// company service, and leave their shape to the representation of the
+// version serving the request.
+type representation interface {
+	user(u *pb.User) any
+	// parseUser reads a user sent by a client.
+	parseUser(data []byte) (*pb.User, error)
+	// company converts a company of the company service.
+	company(data json.RawMessage) (any, error)
+	companyList(companies []any) any
+	// members are the fields a company expanded with its members gets.
+	members(users []*pb.User, truncated bool) map[string]any
+	searchResults(response *pb.SearchUsersResponse) (body any, items []any)
+	importProgress(progress *pb.ImportUsersProgress) any
+	// userCSVColumns names the CSV columns of the id, name, description,
+	// creation time, update time and company of users, in this order.
+	userCSVColumns() []string
+	// created returns the status of a response creating the resource at
+	// location.
+	created(w http.ResponseWriter, location string) int
+	// deleted replies to the deletion of a resource.
+	deleted(w http.ResponseWriter, message string)
+	// protoJSON renders the messages of transcoded routes that have no
+	// representation of their own.
+	protoJSON() protojson.MarshalOptions
+}
+
+// v1Representation is the representation of the gateway before versioning:
+// the JSON of the user messages, with snake_case fields omitted when empty,
+// and the companies as the company service returns them.
+type v1Representation struct{}
+
+func (v1Representation) user(u *pb.User) any {
+	return u
+}
+
+func (v1Representation) parseUser(data []byte) (*pb.User, error) {
+	var user pb.User
+	return &user, json.Unmarshal(data, &user)
+}
+
+func (v1Representation) company(data json.RawMessage) (any, error) {
+	return data, nil
+}
+
+func (v1Representation) companyList(companies []any) any {
+	return companies
+}
+
+func (v1Representation) members(users []*pb.User, truncated bool) map[string]any {
+	if users == nil {
+		users = []*pb.User{}
+	}
+	return map[string]any{"members": users, "members_truncated": truncated}
+}
+
+func (v1Representation) searchResults(response *pb.SearchUsersResponse) (any, []any) {
+	items := make([]any, len(response.Results))
+	for i, result := range response.Results {
+		items[i] = result
+	}
+	return response, items
+}
+
+func (v1Representation) importProgress(progress *pb.ImportUsersProgress) any {
+	return progress
+}
+
+func (v1Representation) userCSVColumns() []string {
+	return []string{"id", "name", "description", "created_at", "updated_at", "company_id"}
+}
+
+func (v1Representation) created(http.ResponseWriter, string) int {
+	return http.StatusOK
+}
+
+func (v1Representation) deleted(w http.ResponseWriter, message string) {
+	w.Write([]byte(message))
+}
+
+func (v1Representation) protoJSON() protojson.MarshalOptions {
+	return protojson.MarshalOptions{UseProtoNames: true}
+}
+
+// v2Representation uses camelCase fields, always present, null when a
+// reference is not set. Lists are wrapped in an object with their items,
+// creations reply 201 with the Location of the resource and deletions 204.
+type v2Representation struct{}
+
+type userV2 struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	CompanyID   *string `json:"companyId"`
+	CreatedAt   string  `json:"createdAt"`
+	UpdatedAt   string  `json:"updatedAt"`
+}
+
+type newUserV2 struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	CompanyID   *string `json:"companyId"`
+}
+
+type companyV2 struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+type listV2 struct {
+	Items []any `json:"items"`
+}
+
+type searchResultV2 struct {
+	User               any     `json:"user"`
+	Rank               float64 `json:"rank"`
+	NameHighlight      string  `json:"nameHighlight"`
+	DescriptionSnippet string  `json:"descriptionSnippet"`
+}
+
+type searchResponseV2 struct {
+	Items         []any   `json:"items"`
+	NextPageToken *string `json:"nextPageToken"`
+	TotalSize     int64   `json:"totalSize"`
+}
+
+type importProgressV2 struct {
+	Received int64 `json:"received"`
+	Created  int64 `json:"created"`
+	Updated  int64 `json:"updated"`
+	Skipped  int64 `json:"skipped"`
+	Done     bool  `json:"done"`
+}
+
+// optional returns nil for empty strings.
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (v2Representation) user(u *pb.User) any {
+	if u == nil {
+		return nil
+	}
+	return userV2{
+		ID:          u.Id,
+		Name:        u.Name,
+		Description: u.Description,
+		CompanyID:   optional(u.CompanyId),
+		CreatedAt:   u.CreatedAt,
+		UpdatedAt:   u.UpdatedAt,
+	}
+}
+
+func (v2Representation) parseUser(data []byte) (*pb.User, error) {
+	var user newUserV2
+	if err := json.Unmarshal(data, &user); err != nil {
+		return nil, err
+	}
+	res := &pb.User{Id: user.ID, Name: user.Name, Description: user.Description}
+	if user.CompanyID != nil {
+		res.CompanyId = *user.CompanyID
+	}
+	return res, nil
+}
+
+func (v2Representation) company(data json.RawMessage) (any, error) {
+	var company Company
+	if err := json.Unmarshal(data, &company); err != nil {
+		return nil, err
+	}
+	return companyV2(company), nil
+}
+
+func (v2Representation) companyList(companies []any) any {
+	return listV2{Items: companies}
+}
+
+func (r v2Representation) members(users []*pb.User, truncated bool) map[string]any {
+	items := make([]any, len(users))
+	for i, u := range users {
+		items[i] = r.user(u)
+	}
+	return map[string]any{"members": items, "membersTruncated": truncated}
+}
+
+func (r v2Representation) searchResults(response *pb.SearchUsersResponse) (any, []any) {
+	items := make([]any, len(response.Results))
+	for i, result := range response.Results {
+		items[i] = searchResultV2{
+			User:               r.user(result.User),
+			Rank:               result.Rank,
+			NameHighlight:      result.NameHighlight,
+			DescriptionSnippet: result.DescriptionSnippet,
+		}
+	}
+	return searchResponseV2{Items: items, NextPageToken: optional(response.NextPageToken), TotalSize: response.TotalSize}, items
+}
+
+func (v2Representation) importProgress(progress *pb.ImportUsersProgress) any {
+	if progress == nil {
+		return importProgressV2{}
+	}
+	return importProgressV2{
+		Received: progress.Received,
+		Created:  progress.Created,
+		Updated:  progress.Updated,
+		Skipped:  progress.Skipped,
+		Done:     progress.Done,
+	}
+}
+
+func (v2Representation) userCSVColumns() []string {
+	return []string{"id", "name", "description", "createdAt", "updatedAt", "companyId"}
+}
+
+func (v2Representation) created(w http.ResponseWriter, location string) int {
+	w.Header().Set("Location", location)
+	return http.StatusCreated
+}
+
+func (v2Representation) deleted(w http.ResponseWriter, _ string) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (v2Representation) protoJSON() protojson.MarshalOptions {
+	return protojson.MarshalOptions{EmitUnpopulated: true}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// Every request gets an id, taken from this header when the client sets
+	// a valid one and generated otherwise. It is returned to the client,
+	// forwarded to the company service with the same header, to the user
+	// service with the metadata key and to NATS consumers with the header,
+	// and logged by every service as requestId.
+	requestIDHeader      = "X-Request-ID"
+	requestIDMetadataKey = "x-request-id"
+
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID accepts the ids that are safe to log and to forward: up to
+// maxRequestIDLength letters, digits and "-_.:".
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// RequestIDMiddleware stores the id of the request in its context, sets it
+// on the response and on the request span. It has to run before
+// LogMiddleware.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.request.id", id))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func withRequestIDMetadata(ctx context.Context) context.Context {
+	if id := requestIDFromContext(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, id)
+	}
+	return ctx
+}
+
+// requestIDUnaryClientInterceptor forwards the request id to the user
+// service.
+func requestIDUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(withRequestIDMetadata(ctx), method, req, reply, cc, opts...)
+}
+
+func requestIDStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(withRequestIDMetadata(ctx), desc, cc, method, opts...)
+}
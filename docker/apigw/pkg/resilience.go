@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Path of the JSON file overriding the default resilience policies of the
+// upstream services, see resilienceConfig.
+const resilienceConfigFile = "RESILIENCE_CONFIG"
+
+// Names of the upstreams, as used in the configuration and in the metrics.
+const (
+	companyUpstream = "company"
+	userUpstream    = "user"
+)
+
+var (
+	errCircuitOpen  = errors.New("circuit breaker is open")
+	errBulkheadFull = errors.New("too many concurrent calls")
+)
+
+// duration is a time.Duration read from JSON strings such as "250ms".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type retryPolicy struct {
+	// Attempts including the first one, 1 disables retries.
+	MaxAttempts    int      `json:"max_attempts"`
+	InitialBackoff duration `json:"initial_backoff"`
+	MaxBackoff     duration `json:"max_backoff"`
+	Multiplier     float64  `json:"multiplier"`
+	// HTTP methods or gRPC method names safe to retry.
+	Methods []string `json:"methods"`
+}
+
+// retryBudgetPolicy caps retries to a fraction of the calls, plus a minimum
+// rate, so that retries cannot multiply the load on a struggling upstream.
+type retryBudgetPolicy struct {
+	Ratio        float64 `json:"ratio"`
+	MinPerSecond float64 `json:"min_per_second"`
+}
+
+type circuitBreakerPolicy struct {
+	// The circuit opens when at least MinCalls calls were made in Window
+	// and this fraction of them failed; 0 disables the breaker.
+	FailureRatio float64  `json:"failure_ratio"`
+	MinCalls     int      `json:"min_calls"`
+	Window       duration `json:"window"`
+	// How long the circuit stays open before letting probes through.
+	OpenTimeout duration `json:"open_timeout"`
+	// Successful probes needed to close the circuit again.
+	HalfOpenProbes int `json:"half_open_probes"`
+}
+
+type bulkheadPolicy struct {
+	// Maximum number of concurrent calls, 0 means unlimited.
+	MaxConcurrent int `json:"max_concurrent"`
+	// How long a call waits for a free slot before being rejected.
+	MaxWait duration `json:"max_wait"`
+}
+
+type resiliencePolicy struct {
+	Retry          retryPolicy          `json:"retry"`
+	RetryBudget    retryBudgetPolicy    `json:"retry_budget"`
+	CircuitBreaker circuitBreakerPolicy `json:"circuit_breaker"`
+	Bulkhead       bulkheadPolicy       `json:"bulkhead"`
+}
+
+// resilienceConfig is the content of RESILIENCE_CONFIG, e.g.
+//
+//	{
+//	  "company": {
+//	    "retry": {"max_attempts": 2},
+//	    "bulkhead": {"max_concurrent": 20, "max_wait": "10ms"}
+//	  }
+//	}
+//
+// Settings not in the file keep their defaults.
+type resilienceConfig struct {
+	Company resiliencePolicy `json:"company"`
+	User    resiliencePolicy `json:"user"`
+}
+
+func defaultResiliencePolicy(methods ...string) resiliencePolicy {
+	return resiliencePolicy{
+		Retry: retryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: duration(25 * time.Millisecond),
+			MaxBackoff:     duration(250 * time.Millisecond),
+			Multiplier:     2,
+			Methods:        methods,
+		},
+		RetryBudget: retryBudgetPolicy{Ratio: 0.2, MinPerSecond: 5},
+		CircuitBreaker: circuitBreakerPolicy{
+			FailureRatio:   0.5,
+			MinCalls:       20,
+			Window:         duration(10 * time.Second),
+			OpenTimeout:    duration(30 * time.Second),
+			HalfOpenProbes: 3,
+		},
+		Bulkhead: bulkheadPolicy{MaxConcurrent: 100, MaxWait: duration(50 * time.Millisecond)},
+	}
+}
+
+func (p *resiliencePolicy) validate() error {
+	for name, d := range map[string]duration{
+		"retry.initial_backoff":        p.Retry.InitialBackoff,
+		"retry.max_backoff":            p.Retry.MaxBackoff,
+		"circuit_breaker.window":       p.CircuitBreaker.Window,
+		"circuit_breaker.open_timeout": p.CircuitBreaker.OpenTimeout,
+		"bulkhead.max_wait":            p.Bulkhead.MaxWait,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s cannot be negative", name)
+		}
+	}
+	switch {
+	case p.Retry.MaxAttempts < 1:
+		return errors.New("retry.max_attempts must be at least 1")
+	case p.Retry.Multiplier < 1:
+		return errors.New("retry.multiplier must be at least 1")
+	case p.RetryBudget.Ratio < 0 || p.RetryBudget.MinPerSecond < 0:
+		return errors.New("retry_budget cannot be negative")
+	case p.Bulkhead.MaxConcurrent < 0:
+		return errors.New("bulkhead.max_concurrent cannot be negative")
+	case p.CircuitBreaker.FailureRatio < 0 || p.CircuitBreaker.FailureRatio > 1:
+		return errors.New("circuit_breaker.failure_ratio must be between 0 and 1")
+	}
+	if p.CircuitBreaker.FailureRatio > 0 {
+		// Without probes an open circuit would never close again.
+		switch {
+		case p.CircuitBreaker.MinCalls < 1:
+			return errors.New("circuit_breaker.min_calls must be at least 1")
+		case p.CircuitBreaker.HalfOpenProbes < 1:
+			return errors.New("circuit_breaker.half_open_probes must be at least 1")
+		case p.CircuitBreaker.Window == 0:
+			return errors.New("circuit_breaker.window must be positive")
+		}
+	}
+	return nil
+}
+
+type upstreams struct {
+	company *upstream
+	user    *upstream
+}
+
+// getUpstreams returns the upstreams with the policies of RESILIENCE_CONFIG.
+// They are shared by all requests, so that breakers and budgets see the
+// whole traffic.
+var getUpstreams = sync.OnceValues(func() (*upstreams, error) {
+	config := resilienceConfig{
+		Company: defaultResiliencePolicy(http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete),
+		User:    defaultResiliencePolicy("GetUser", "SearchUsers", "ListUsers", "DeleteUser"),
+	}
+	if path, exists := os.LookupEnv(resilienceConfigFile); exists {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", resilienceConfigFile, err)
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", resilienceConfigFile, err)
+		}
+	}
+	if err := config.Company.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s policy in %s: %w", companyUpstream, resilienceConfigFile, err)
+	}
+	if err := config.User.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s policy in %s: %w", userUpstream, resilienceConfigFile, err)
+	}
+	return &upstreams{
+		company: newUpstream(companyUpstream, config.Company, isHTTPFailure),
+		user:    newUpstream(userUpstream, config.User, isGrpcFailure),
+	}, nil
+})
+
+// upstream applies a resilience policy to the calls to a service.
+type upstream struct {
+	name     string
+	policy   resiliencePolicy
+	breaker  *circuitBreaker
+	budget   *retryBudget
+	bulkhead chan struct{}
+	// isFailure tells whether a call failed because of the upstream, as
+	// opposed to, say, a not found.
+	isFailure func(error) bool
+}
+
+func newUpstream(name string, policy resiliencePolicy, isFailure func(error) bool) *upstream {
+	u := &upstream{
+		name:      name,
+		policy:    policy,
+		breaker:   newCircuitBreaker(name, policy.CircuitBreaker),
+		budget:    &retryBudget{policy: policy.RetryBudget},
+		isFailure: isFailure,
+	}
+	if policy.Bulkhead.MaxConcurrent > 0 {
+		u.bulkhead = make(chan struct{}, policy.Bulkhead.MaxConcurrent)
+	}
+	return u
+}
+
+func (u *upstream) acquire(ctx context.Context) (func(), error) {
+	if u.bulkhead == nil {
+		return func() {}, nil
+	}
+	release := func() {
+		<-u.bulkhead
+		upstreamInFlight.WithLabelValues(u.name).Dec()
+	}
+	select {
+	case u.bulkhead <- struct{}{}:
+		upstreamInFlight.WithLabelValues(u.name).Inc()
+		return release, nil
+	default:
+	}
+	timer := time.NewTimer(time.Duration(u.policy.Bulkhead.MaxWait))
+	defer timer.Stop()
+	select {
+	case u.bulkhead <- struct{}{}:
+		upstreamInFlight.WithLabelValues(u.name).Inc()
+		return release, nil
+	case <-timer.C:
+		return nil, errBulkheadFull
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// backoff returns the delay before the given retry, with full jitter.
+func (u *upstream) backoff(retry int) time.Duration {
+	p := u.policy.Retry
+	ceiling := math.Min(float64(p.MaxBackoff), float64(p.InitialBackoff)*math.Pow(p.Multiplier, float64(retry)))
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(ceiling)) + 1)
+}
+
+// call runs fn under the policy of the upstream, retrying it when method is
+// one of the retriable ones.
+func (u *upstream) call(ctx context.Context, method string, fn func(context.Context) error) error {
+	release, err := u.acquire(ctx)
+	if err != nil {
+		upstreamCalls.WithLabelValues(u.name, "bulkhead_full").Inc()
+		return err
+	}
+	defer release()
+
+	u.budget.deposit()
+	retriable := slices.Contains(u.policy.Retry.Methods, method)
+	for attempt := 0; ; attempt++ {
+		done, err := u.breaker.allow()
+		if err != nil {
+			upstreamCalls.WithLabelValues(u.name, "circuit_open").Inc()
+			return err
+		}
+		err = fn(ctx)
+		failed := err != nil && u.isFailure(err)
+		done(!failed)
+		if !failed {
+			upstreamCalls.WithLabelValues(u.name, "success").Inc()
+			return err
+		}
+		upstreamCalls.WithLabelValues(u.name, "failure").Inc()
+
+		if !retriable || attempt+1 >= u.policy.Retry.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		if !u.budget.withdraw() {
+			upstreamRetryBudgetExhausted.WithLabelValues(u.name).Inc()
+			return err
+		}
+		delay := u.backoff(attempt)
+		zerolog.Ctx(ctx).Warn().Err(err).Str("upstream", u.name).Msgf("retrying %s in %v", method, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		upstreamRetries.WithLabelValues(u.name).Inc()
+	}
+}
+
+// retryBudget counts calls and retries over fixed windows of
+// retryBudgetWindow.
+type retryBudget struct {
+	policy retryBudgetPolicy
+
+	mu          sync.Mutex
+	windowStart time.Time
+	calls       int
+	retries     int
+}
+
+const retryBudgetWindow = 10 * time.Second
+
+func (b *retryBudget) roll(now time.Time) {
+	if now.Sub(b.windowStart) > retryBudgetWindow {
+		b.windowStart, b.calls, b.retries = now, 0, 0
+	}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(time.Now())
+	b.calls++
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(time.Now())
+	allowed := b.policy.Ratio*float64(b.calls) + b.policy.MinPerSecond*retryBudgetWindow.Seconds()
+	if float64(b.retries+1) > allowed {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	return [...]string{"closed", "half_open", "open"}[s]
+}
+
+type circuitBreaker struct {
+	name   string
+	policy circuitBreakerPolicy
+
+	mu          sync.Mutex
+	state       circuitState
+	windowStart time.Time
+	calls       int
+	failures    int
+	openedAt    time.Time
+	// Probes currently in flight and successful so far while half-open.
+	probes    int
+	successes int
+}
+
+func newCircuitBreaker(name string, policy circuitBreakerPolicy) *circuitBreaker {
+	upstreamCircuitState.WithLabelValues(name).Set(float64(circuitClosed))
+	return &circuitBreaker{name: name, policy: policy}
+}
+
+func (b *circuitBreaker) setState(state circuitState) {
+	b.state = state
+	b.windowStart, b.calls, b.failures = time.Now(), 0, 0
+	b.probes, b.successes = 0, 0
+	if state == circuitOpen {
+		b.openedAt = time.Now()
+	}
+	upstreamCircuitState.WithLabelValues(b.name).Set(float64(state))
+	upstreamCircuitTransitions.WithLabelValues(b.name, state.String()).Inc()
+}
+
+// allow tells whether a call may go through. Its outcome must be reported
+// with done.
+func (b *circuitBreaker) allow() (done func(success bool), err error) {
+	if b.policy.FailureRatio <= 0 {
+		return func(bool) {}, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitOpen {
+		if time.Since(b.openedAt) < time.Duration(b.policy.OpenTimeout) {
+			return nil, errCircuitOpen
+		}
+		b.setState(circuitHalfOpen)
+	}
+	if b.state == circuitHalfOpen {
+		if b.probes >= b.policy.HalfOpenProbes {
+			return nil, errCircuitOpen
+		}
+		b.probes++
+		return b.probeDone, nil
+	}
+	return b.callDone, nil
+}
+
+// retryAfter is how long until the circuit lets probes through.
+func (b *circuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != circuitOpen {
+		return 0
+	}
+	return time.Duration(b.policy.OpenTimeout) - time.Since(b.openedAt)
+}
+
+func (b *circuitBreaker) callDone(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != circuitClosed {
+		return
+	}
+	if time.Since(b.windowStart) > time.Duration(b.policy.Window) {
+		b.windowStart, b.calls, b.failures = time.Now(), 0, 0
+	}
+	b.calls++
+	if !success {
+		b.failures++
+	}
+	if b.calls >= b.policy.MinCalls && float64(b.failures) >= b.policy.FailureRatio*float64(b.calls) {
+		b.setState(circuitOpen)
+	}
+}
+
+func (b *circuitBreaker) probeDone(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != circuitHalfOpen {
+		return
+	}
+	if !success {
+		b.setState(circuitOpen)
+		return
+	}
+	b.successes++
+	if b.successes >= b.policy.HalfOpenProbes {
+		b.setState(circuitClosed)
+	}
+}
+
+// upstreamStatusError is returned by resilientTransport for responses
+// counting as failures, so that they can be told apart and retried.
+type upstreamStatusError struct {
+	resp *http.Response
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream replied %s", e.resp.Status)
+}
+
+func isHTTPFailure(err error) bool {
+	// Cancellations come from our side, not from the upstream.
+	return !errors.Is(err, context.Canceled)
+}
+
+func isGrpcFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal, codes.Unknown:
+		return true
+	default:
+		return false
+	}
+}
+
+// resilientTransport applies the policy of an upstream to HTTP requests.
+// Responses with status 5xx or 429 count as failures.
+type resilientTransport struct {
+	upstream *upstream
+	next     http.RoundTripper
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var resp *http.Response
+	attempts := 0
+	err := t.upstream.call(req.Context(), req.Method, func(ctx context.Context) error {
+		if resp != nil {
+			// A previous attempt failed, discard its response.
+			resp.Body.Close()
+			resp = nil
+		}
+		attempt := req
+		if attempts > 0 {
+			// The previous attempt consumed the body, whether it got a
+			// response or not.
+			attempt = req.Clone(ctx)
+			if req.Body != nil && req.Body != http.NoBody {
+				if req.GetBody == nil {
+					return errors.New("request body cannot be replayed")
+				}
+				body, err := req.GetBody()
+				if err != nil {
+					return err
+				}
+				attempt.Body = body
+			}
+		}
+		attempts++
+		var err error
+		resp, err = t.next.RoundTrip(attempt)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return &upstreamStatusError{resp: resp}
+		}
+		return nil
+	})
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		// Retries are over, hand the last response to the caller.
+		return statusErr.resp, nil
+	}
+	if err != nil && resp != nil {
+		// The circuit opened or the deadline expired between attempts.
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, err
+}
+
+// resilienceUnaryClientInterceptor applies the policy of the user upstream
+// to unary calls.
+func resilienceUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	u, err := getUpstreams()
+	if err != nil {
+		return err
+	}
+	_, name := splitMethodName(method)
+	err = userUpstreamFromContext(ctx, u).call(ctx, name, func(ctx context.Context) error {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	})
+	return toGrpcError(err)
+}
+
+// resilienceStreamClientInterceptor only rejects streams while the circuit
+// is open: streams are long lived, so they neither take a bulkhead slot nor
+// get retried.
+func resilienceStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	u, err := getUpstreams()
+	if err != nil {
+		return nil, err
+	}
+	if user := userUpstreamFromContext(ctx, u); user.breaker.retryAfter() > 0 {
+		upstreamCalls.WithLabelValues(user.name, "circuit_open").Inc()
+		return nil, toGrpcError(errCircuitOpen)
+	}
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// userUpstreamFromContext returns the upstream of the user service target
+// assigned to the request, the user upstream when none is.
+func userUpstreamFromContext(ctx context.Context, u *upstreams) *upstream {
+	if a := targetAssignmentFromContext(ctx); a != nil && a.kind == grpcUpstreamKind && a.upstream != nil {
+		return a.upstream
+	}
+	return u.user
+}
+
+func toGrpcError(err error) error {
+	if errors.Is(err, errCircuitOpen) || errors.Is(err, errBulkheadFull) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return err
+}
+
+func splitMethodName(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", fullMethod
+}
+
+// upstreamError replies to a failed call to u, with Retry-After when the
+// call was not even attempted.
+func upstreamError(w http.ResponseWriter, r *http.Request, u *upstream, err error) {
+	zerolog.Ctx(r.Context()).Error().Err(err).Msg("upstream call failed")
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		retryAfter := math.Ceil(u.breaker.retryAfter().Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, retryAfter))))
+	case errors.Is(err, errBulkheadFull):
+		w.Header().Set("Retry-After", "1")
+	}
+	http.Error(w, err.Error(), companyErrorStatus(err))
+}
+
+// companyErrorStatus maps a failed upstream call to the status returned to
+// the client.
+func companyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errCircuitOpen), errors.Is(err, errBulkheadFull):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Path of the JSON route configuration, see routesConfig. When not set the
+// gateway serves the routes of routes.json. The file is reloaded when it
+// changes.
+const routesConfigFile = "ROUTES_CONFIG"
+
+// The route configuration file is checked for changes this often.
+const routesReloadCheckInterval = 10 * time.Second
+
+// Kinds of upstreams a route can forward to.
+const (
+	restUpstreamKind = "rest"
+	grpcUpstreamKind = "grpc"
+	natsUpstreamKind = "nats"
+)
+
+//go:embed routes.json
+var defaultRoutesConfig []byte
+
+type routeUpstream struct {
+	Kind string `json:"kind"`
+	// Base URL of a REST upstream, full method name of a gRPC one or
+	// subject of a NATS one. ${VAR} is replaced by the environment variable
+	// VAR on each call. REST routes calling a group have no base URL.
+	Target string `json:"target"`
+	// Upstream of RESILIENCE_CONFIG whose policy applies to the calls. REST
+	// routes without a name are called without one; gRPC routes always
+	// call the user service.
+	Name string `json:"name"`
+	// Upstream group of the REST and gRPC routes whose targets share the
+	// traffic, the address of the user service otherwise.
+	Group string `json:"group"`
+}
+
+type routeAuth struct {
+	// Scopes the caller needs, an empty list only requires a valid token.
+	Scopes []string `json:"scopes"`
+}
+
+type routeRewrite struct {
+	// Path of the upstream call for REST routes, {param} is replaced by the
+	// route parameter. By default the request path without the version
+	// prefix.
+	Path string `json:"path"`
+	// Headers set on and removed from the upstream request, or the message
+	// for NATS routes.
+	SetHeaders    map[string]string `json:"set_headers"`
+	RemoveHeaders []string          `json:"remove_headers"`
+}
+
+// routeConfig is a route served under the prefix of every API version.
+type routeConfig struct {
+	Method   string        `json:"method"`
+	Path     string        `json:"path"`
+	Upstream routeUpstream `json:"upstream"`
+	// Deadline of the upstream call, none by default.
+	Timeout duration `json:"timeout"`
+	// Routes without auth are public.
+	Auth    *routeAuth   `json:"auth"`
+	Rewrite routeRewrite `json:"rewrite"`
+	// Response cache serving the route, users or companies.
+	Cache string `json:"cache"`
+	// Whether retries with the same Idempotency-Key are replayed.
+	Idempotent bool `json:"idempotent"`
+	// Handler of ?expand, see expansions.
+	Expand string `json:"expand"`
+	// Translations of the request and response bodies, see
+	// requestTransforms and responseTransforms.
+	Request  string `json:"request"`
+	Response string `json:"response"`
+	// Field of the request message of a transcoded gRPC route taking the
+	// request body, * for the whole message. The other fields are set from
+	// the route parameters and the query.
+	Body string `json:"body"`
+	// Shadow upstream the requests of a REST route are copied to.
+	Mirror *routeMirror `json:"mirror"`
+
+	group    *upstreamGroup
+	upstream *upstream
+	handler  http.Handler
+}
+
+// routesConfig is the content of ROUTES_CONFIG, e.g.
+//
+//	{
+//	  "routes": [
+//	    {
+//	      "method": "GET",
+//	      "path": "/companies/{id}",
+//	      "upstream": {"kind": "rest", "name": "company", "target": "http://${REST_COMPANY_HOST}:${REST_COMPANY_PORT}"},
+//	      "timeout": "2s",
+//	      "auth": {"scopes": ["companies:read"]},
+//	      "rewrite": {"path": "/companies/{id}", "set_headers": {"X-Source": "apigw"}},
+//	      "response": "company"
+//	    }
+//	  ]
+//	}
+//
+// The file replaces routes.json as a whole, so it has to list the default
+// routes that should still be served. groups split the traffic of the
+// routes calling them between deployments, e.g.
+//
+//	"groups": {
+//	  "user": {
+//	    "targets": [
+//	      {"name": "stable", "target": "${GRPC_USER_HOST}:${GRPC_USER_PORT}", "weight": 95},
+//	      {"name": "canary", "target": "${GRPC_USER_CANARY_HOST}:${GRPC_USER_PORT}", "weight": 5}
+//	    ],
+//	    "sticky": {"by": "subject"}
+//	  }
+//	}
+type routesConfig struct {
+	Routes []*routeConfig            `json:"routes"`
+	Groups map[string]*upstreamGroup `json:"groups"`
+}
+
+// grpcBindings serve the user service methods that need more than
+// transcoding, translating between the representation of the API version
+// and the protobuf messages. gRPC routes to other methods are transcoded.
+var grpcBindings = map[string]http.HandlerFunc{
+	"user.UserService/GetUser":     getUser,
+	"user.UserService/CreateUser":  createUser,
+	"user.UserService/DeleteUser":  deleteUser,
+	"user.UserService/SearchUsers": searchUsers,
+	"user.UserService/ImportUsers": importUsers,
+	"user.UserService/ExportUsers": exportUsers,
+}
+
+// expansions serve the requests with an expand query parameter.
+var expansions = map[string]http.HandlerFunc{
+	"user":    getUserExpanded,
+	"company": getCompanyExpanded,
+}
+
+// requestTransform turns the body of a request into the one sent upstream.
+type requestTransform func(r *http.Request, body []byte) ([]byte, error)
+
+var requestTransforms = map[string]requestTransform{
+	// The consumers expect the users as the user service messages.
+	"user": func(r *http.Request, body []byte) ([]byte, error) {
+		user, err := representationFromContext(r.Context()).parseUser(body)
+		if err != nil {
+			return nil, fmt.Errorf("request body is not a valid user: %w", err)
+		}
+		return json.Marshal(user)
+	},
+}
+
+// responseTransform replies with the successful response body of a REST
+// upstream.
+type responseTransform func(w http.ResponseWriter, r *http.Request, body []byte)
+
+var responseTransforms = map[string]responseTransform{
+	"company": func(w http.ResponseWriter, r *http.Request, body []byte) {
+		status := http.StatusOK
+		if r.Method == http.MethodPost {
+			var company Company
+			json.Unmarshal(body, &company)
+			status = representationFromContext(r.Context()).created(w, resourcePath(r.Context(), "companies", company.ID))
+		}
+		writeCompany(w, r, status, body)
+	},
+	"company_list": func(w http.ResponseWriter, r *http.Request, body []byte) {
+		ctx := r.Context()
+		var companies []json.RawMessage
+		if err := json.Unmarshal(body, &companies); err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("company service replied with invalid JSON")
+			http.Error(w, "company service replied with invalid JSON", http.StatusBadGateway)
+			return
+		}
+		representation := representationFromContext(ctx)
+		items := make([]any, len(companies))
+		for i, company := range companies {
+			var err error
+			if items[i], err = representation.company(company); err != nil {
+				zerolog.Ctx(ctx).Error().Err(err).Msg("company service replied with an invalid company")
+				http.Error(w, "company service replied with an invalid company", http.StatusBadGateway)
+				return
+			}
+		}
+		writeList(w, r, representation.companyList(items), nil, items)
+	},
+	"company_deleted": func(w http.ResponseWriter, r *http.Request, _ []byte) {
+		representationFromContext(r.Context()).deleted(w, "Company deleted")
+	},
+}
+
+// Messages of the NATS routes share a single connection.
+var getRoutesNATSConnection = sync.OnceValues(createNATSConnection)
+
+// parseRoutesConfig parses and validates a route configuration, building
+// the handlers of its routes.
+func parseRoutesConfig(data []byte) (*routesConfig, error) {
+	var config routesConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	for name, group := range config.Groups {
+		group.name = name
+		if err := group.validate(); err != nil {
+			return nil, fmt.Errorf("group %s: %w", name, err)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, route := range config.Routes {
+		key := route.Method + " " + route.Path
+		if seen[key] {
+			return nil, fmt.Errorf("route %s is defined twice", key)
+		}
+		seen[key] = true
+		if route.Upstream.Group != "" {
+			if route.group = config.Groups[route.Upstream.Group]; route.group == nil {
+				return nil, fmt.Errorf("route %s: unknown group %q", key, route.Upstream.Group)
+			}
+		}
+		if err := route.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: %w", key, err)
+		}
+		if err := route.buildHandler(); err != nil {
+			return nil, fmt.Errorf("route %s: %w", key, err)
+		}
+	}
+	return &config, nil
+}
+
+func (route *routeConfig) validate() error {
+	switch route.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return fmt.Errorf("unsupported method %q", route.Method)
+	}
+	if !strings.HasPrefix(route.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	if route.Upstream.Target == "" && (route.Upstream.Kind != restUpstreamKind || route.group == nil) {
+		return fmt.Errorf("upstream has no target")
+	}
+	if route.Upstream.Target != "" && route.Upstream.Kind == restUpstreamKind && route.group != nil {
+		return fmt.Errorf("the targets of group %s replace the upstream target", route.Upstream.Group)
+	}
+	if route.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if err := checkTarget(route.Upstream.Target); err != nil {
+		return fmt.Errorf("upstream target: %w", err)
+	}
+
+	switch route.Upstream.Kind {
+	case restUpstreamKind:
+		if route.Upstream.Name != "" && route.Upstream.Name != companyUpstream && route.Upstream.Name != userUpstream {
+			return fmt.Errorf("unknown upstream name %q", route.Upstream.Name)
+		}
+	case grpcUpstreamKind:
+		if route.Upstream.Name != "" && route.Upstream.Name != userUpstream {
+			return fmt.Errorf("gRPC routes can only call the %s upstream", userUpstream)
+		}
+		if _, ok := grpcBindings[route.Upstream.Target]; ok && route.Body != "" {
+			return fmt.Errorf("%s has its own handler, its body cannot be mapped", route.Upstream.Target)
+		}
+		if route.Request != "" || route.Response != "" || route.Rewrite.Path != "" || len(route.Rewrite.SetHeaders) > 0 || len(route.Rewrite.RemoveHeaders) > 0 {
+			return fmt.Errorf("gRPC routes cannot transform or rewrite requests")
+		}
+	case natsUpstreamKind:
+		if route.Upstream.Name != "" || route.group != nil {
+			return fmt.Errorf("NATS routes have no upstream name or group")
+		}
+		if route.Response != "" || route.Rewrite.Path != "" {
+			return fmt.Errorf("NATS routes have no response or path to rewrite")
+		}
+	default:
+		return fmt.Errorf("unknown upstream kind %q", route.Upstream.Kind)
+	}
+	if route.Upstream.Kind != grpcUpstreamKind && route.Body != "" {
+		return fmt.Errorf("only gRPC routes map their body")
+	}
+	if route.Mirror != nil {
+		if route.Upstream.Kind != restUpstreamKind {
+			return fmt.Errorf("only REST routes are mirrored")
+		}
+		if err := route.Mirror.validate(); err != nil {
+			return err
+		}
+	}
+
+	if route.Cache != "" && route.Cache != "users" && route.Cache != "companies" {
+		return fmt.Errorf("unknown cache %q", route.Cache)
+	}
+	if _, ok := expansions[route.Expand]; route.Expand != "" && !ok {
+		return fmt.Errorf("unknown expansion %q", route.Expand)
+	}
+	if _, ok := requestTransforms[route.Request]; route.Request != "" && !ok {
+		return fmt.Errorf("unknown request transform %q", route.Request)
+	}
+	if _, ok := responseTransforms[route.Response]; route.Response != "" && !ok {
+		return fmt.Errorf("unknown response transform %q", route.Response)
+	}
+	return nil
+}
+
+func (route *routeConfig) buildHandler() error {
+	var handler http.HandlerFunc
+	switch route.Upstream.Kind {
+	case restUpstreamKind:
+		u, err := getUpstreams()
+		if err != nil {
+			return err
+		}
+		switch route.Upstream.Name {
+		case companyUpstream:
+			route.upstream = u.company
+		case userUpstream:
+			route.upstream = u.user
+		}
+		handler = route.restHandler(route.upstream)
+	case grpcUpstreamKind:
+		u, err := getUpstreams()
+		if err != nil {
+			return err
+		}
+		route.upstream = u.user
+		if binding, ok := grpcBindings[route.Upstream.Target]; ok {
+			handler = binding
+			break
+		}
+		t, err := newTranscoder(route.Upstream.Target, route.Body, routeParams(route.Path))
+		if err != nil {
+			return err
+		}
+		handler = t.ServeHTTP
+	case natsUpstreamKind:
+		handler = route.natsHandler()
+	}
+	if route.Expand != "" {
+		handler = expandable(handler, expansions[route.Expand])
+	}
+	route.handler = handler
+	return nil
+}
+
+// Parameters of chi patterns, {name} or {name:regexp}.
+var routeParam = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+func routeParams(pattern string) []string {
+	var res []string
+	for _, match := range routeParam.FindAllStringSubmatch(pattern, -1) {
+		res = append(res, match[1])
+	}
+	return res
+}
+
+// middlewares returns what runs between the version middlewares and the
+// handler of the route.
+func (route *routeConfig) middlewares(auth *authenticator, caches *responseCaches, idempotency *idempotencyStore) []func(http.Handler) http.Handler {
+	var res []func(http.Handler) http.Handler
+	if route.Auth != nil {
+		res = append(res, auth.require(route.Auth.Scopes...))
+	}
+	// The target is assigned before the cache, which keeps the responses
+	// of each target apart, and counts the hits of the target.
+	if route.group != nil {
+		res = append(res, route.group.Middleware(route.Upstream.Kind, route.upstream))
+	}
+	switch route.Cache {
+	case "users":
+		res = append(res, caches.users.Middleware)
+	case "companies":
+		res = append(res, caches.companies.Middleware)
+	}
+	if route.Idempotent {
+		res = append(res, idempotency.Middleware)
+	}
+	if route.Timeout > 0 {
+		timeout := time.Duration(route.Timeout)
+		res = append(res, func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				defer cancel()
+				next.ServeHTTP(w, r.WithContext(ctx))
+			})
+		})
+	}
+	return res
+}
+
+// expandTarget replaces the environment variables in the target of an
+// upstream, checked by checkTarget.
+func expandTarget(target string) string {
+	return os.Expand(target, getEnvString)
+}
+
+// checkTarget fails when the target of an upstream refers to environment
+// variables that are not set, so that the configuration is rejected rather
+// than its requests failing.
+func checkTarget(target string) error {
+	var missing []string
+	os.Expand(target, func(name string) string {
+		if _, exists := os.LookupEnv(name); !exists {
+			missing = append(missing, name)
+		}
+		return ""
+	})
+	if len(missing) > 0 {
+		return fmt.Errorf("%s not set", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// requestBody reads the body of r through the request transform of the
+// route, replying on its own when the body cannot be used.
+func (route *routeConfig) requestBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		bodyReadError(w, err)
+		return nil, false
+	}
+	if route.Request != "" {
+		if body, err = requestTransforms[route.Request](r, body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	return body, true
+}
+
+// upstreamPath returns the path of a REST upstream call.
+func (route *routeConfig) upstreamPath(r *http.Request) string {
+	if route.Rewrite.Path == "" {
+		return strings.TrimPrefix(r.URL.EscapedPath(), apiVersionFromContext(r.Context()).prefix)
+	}
+	path := route.Rewrite.Path
+	params := chi.RouteContext(r.Context()).URLParams
+	for i, key := range params.Keys {
+		path = strings.ReplaceAll(path, "{"+key+"}", url.PathEscape(params.Values[i]))
+	}
+	return path
+}
+
+func (route *routeConfig) rewriteHeaders(header http.Header) {
+	for name, value := range route.Rewrite.SetHeaders {
+		header.Set(name, value)
+	}
+	for _, name := range route.Rewrite.RemoveHeaders {
+		header.Del(name)
+	}
+}
+
+// Headers describing a connection rather than a response, not relayed to
+// the client.
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length"}
+
+// restHandler forwards the requests to a REST upstream, calling it with the
+// policy of u when not nil, or to the target of the group assigned to the
+// request. Upstream failures are replied as 502, other unsuccessful
+// responses are relayed as they are.
+func (route *routeConfig) restHandler(u *upstream) http.HandlerFunc {
+	client := newUpstreamHTTPClient(u)
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		body, ok := route.requestBody(w, r)
+		if !ok {
+			return
+		}
+		client, u, base := client, u, route.Upstream.Target
+		if a := targetAssignmentFromContext(ctx); a != nil {
+			client, u, base = newUpstreamHTTPClient(a.upstream), a.upstream, a.target.Target
+		}
+		uri := route.upstreamPath(r)
+		if r.URL.RawQuery != "" {
+			uri += "?" + r.URL.RawQuery
+		}
+		req, err := newHTTPRequest(ctx, r.Method, expandTarget(base)+uri, bytes.NewReader(body))
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("could not create upstream request")
+			http.Error(w, "could not create upstream request", http.StatusInternalServerError)
+			return
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != "" && len(body) > 0 {
+			req.Header.Set("Content-Type", contentType)
+		}
+		route.rewriteHeaders(req.Header)
+
+		mirrored := route.Mirror.start(ctx, r.Method+" "+route.Path, r.Method, uri, req.Header, body)
+		resp, err := client.Do(req)
+		if err != nil {
+			mirrored.finish(0)
+			upstreamError(w, r, u, err)
+			return
+		}
+		defer resp.Body.Close()
+		mirrored.capture(resp)
+		defer mirrored.finish(resp.StatusCode)
+		switch {
+		case resp.StatusCode >= 500:
+			zerolog.Ctx(ctx).Error().Msgf("upstream replied %s", resp.Status)
+			http.Error(w, fmt.Sprintf("upstream replied %s", resp.Status), http.StatusBadGateway)
+		case resp.StatusCode >= 300 || route.Response == "":
+			for name, values := range resp.Header {
+				if !slices.Contains(hopByHopHeaders, name) {
+					w.Header()[name] = values
+				}
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+		default:
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				upstreamError(w, r, u, err)
+				return
+			}
+			responseTransforms[route.Response](w, r, data)
+		}
+	}
+}
+
+// natsHandler publishes the request bodies to the subject of the route and
+// replies 202 once they are sent.
+func (route *routeConfig) natsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		logger := zerolog.Ctx(ctx)
+		body, ok := route.requestBody(w, r)
+		if !ok {
+			return
+		}
+		conn, err := getRoutesNATSConnection()
+		if err != nil {
+			logger.Error().Err(err).Msg("could not connect to NATS")
+			http.Error(w, "message broker unavailable", http.StatusBadGateway)
+			return
+		}
+
+		header := make(nats.Header)
+		if id := requestIDFromContext(ctx); id != "" {
+			header.Set(requestIDHeader, id)
+		}
+		// JetStream drops messages with the same id published within the
+		// duplicate window of the stream, across gateway replicas too.
+		if key := idempotencyKey(r); key != "" {
+			header.Set(nats.MsgIdHdr, key)
+		}
+		route.rewriteHeaders(http.Header(header))
+
+		_, span := tracer.Start(ctx, "PublishWithTrace")
+		defer span.End()
+
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+		msg := &nats.Msg{
+			Subject: expandTarget(route.Upstream.Target),
+			Data:    body,
+			Header:  header,
+		}
+		logger.Info().Msgf("Publishing message to subject %s, headers %v", msg.Subject, header)
+		if err := conn.PublishMsg(msg); err != nil {
+			logger.Error().Err(err).Msg("could not publish message")
+			http.Error(w, "could not publish message", http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// routeReloader serves the router built from the route configuration,
+// replacing it when ROUTES_CONFIG changes. Requests in flight complete on
+// the router they started on.
+type routeReloader struct {
+	file    string
+	build   func(*routesConfig) http.Handler
+	current atomic.Value
+	modTime time.Time
+}
+
+// newRouteReloader loads the route configuration, build turns it into the
+// router.
+func newRouteReloader(build func(*routesConfig) http.Handler) (*routeReloader, error) {
+	rr := &routeReloader{file: os.Getenv(routesConfigFile), build: build}
+	if err := rr.reload(); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
+
+func (rr *routeReloader) reload() (err error) {
+	data := defaultRoutesConfig
+	if rr.file != "" {
+		info, err := os.Stat(rr.file)
+		if err != nil {
+			return err
+		}
+		// A broken file is not retried until it changes again.
+		rr.modTime = info.ModTime()
+		if data, err = os.ReadFile(rr.file); err != nil {
+			return err
+		}
+	}
+	routes, err := parseRoutesConfig(data)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", routesConfigFile, err)
+	}
+	// chi panics on invalid patterns.
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("invalid %s: %v", routesConfigFile, p)
+		}
+	}()
+	rr.current.Store(rr.build(routes))
+	return nil
+}
+
+// watch reloads the route configuration whenever the file changes, until
+// ctx is done. Invalid configurations keep the current routes.
+func (rr *routeReloader) watch(ctx context.Context) {
+	if rr.file == "" {
+		return
+	}
+	ticker := time.NewTicker(routesReloadCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(rr.file)
+		if err != nil {
+			log.Error().Err(err).Msg("could not check the routes, keeping the current ones")
+			continue
+		}
+		if info.ModTime().Equal(rr.modTime) {
+			continue
+		}
+		if err := rr.reload(); err != nil {
+			routeReloads.WithLabelValues("failure").Inc()
+			log.Error().Err(err).Msg("could not reload the routes, keeping the current ones")
+			continue
+		}
+		routeReloads.WithLabelValues("success").Inc()
+		log.Info().Msg("Routes reloaded")
+	}
+}
+
+func (rr *routeReloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rr.current.Load().(http.Handler).ServeHTTP(w, r)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	pb "github.com/fcracker79/k8s-experiment/docker/rest/apigw/proto/user"
+
+	"github.com/rs/zerolog"
+)
+
+// searchUsers serves GET /users/search?q=...&page_size=...&page_token=...
+func searchUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	req := &pb.SearchUsersRequest{
+		Query:     query.Get("q"),
+		PageToken: query.Get("page_token"),
+	}
+	if req.Query == "" {
+		http.Error(w, "missing q parameter", http.StatusBadRequest)
+		return
+	}
+	if pageSize := query.Get("page_size"); pageSize != "" {
+		size, err := strconv.ParseInt(pageSize, 10, 32)
+		if err != nil {
+			http.Error(w, "page_size must be a number", http.StatusBadRequest)
+			return
+		}
+		req.PageSize = int32(size)
+	}
+
+	connection, err := createGrpcConnection(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("did not connect")
+		http.Error(w, "user service unavailable", http.StatusBadGateway)
+		return
+	}
+	defer connection.Close()
+	c := pb.NewUserServiceClient(connection)
+	response, err := c.SearchUsers(ctx, req)
+	if err != nil {
+		http.Error(w, err.Error(), grpcStatusToHTTP(err))
+		return
+	}
+	body, items := representationFromContext(ctx).searchResults(response)
+	writeList(w, r, body, response, items)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "github.com/fcracker79/k8s-experiment/docker/rest/apigw/proto/user"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Path of a binary FileDescriptorSet, as written by protoc
+// --include_imports --descriptor_set_out or buf build -o, describing the
+// methods gRPC routes can be transcoded to. By default the services the
+// gateway is compiled with.
+const grpcDescriptorSetFile = "GRPC_DESCRIPTOR_SET"
+
+var getGrpcDescriptors = sync.OnceValues(func() (*protoregistry.Files, error) {
+	file, exists := os.LookupEnv(grpcDescriptorSetFile)
+	if !exists {
+		return protoregistry.GlobalFiles, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", grpcDescriptorSetFile, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", grpcDescriptorSetFile, err)
+	}
+	return files, nil
+})
+
+// transcoder serves a route with a gRPC method of the user service,
+// translating the HTTP request into the request message and the response
+// message into JSON, or NDJSON for server streams.
+type transcoder struct {
+	method protoreflect.MethodDescriptor
+	// Field of the request message taking the body, * for the whole
+	// message, empty when the body is ignored.
+	body string
+}
+
+func newTranscoder(fullMethod, body string, pathParams []string) (*transcoder, error) {
+	files, err := getGrpcDescriptors()
+	if err != nil {
+		return nil, err
+	}
+	serviceName, methodName := splitMethodName(fullMethod)
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, fmt.Errorf("unknown gRPC service %q", serviceName)
+	}
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a gRPC service", serviceName)
+	}
+	method := service.Methods().ByName(protoreflect.Name(methodName))
+	if method == nil {
+		return nil, fmt.Errorf("unknown gRPC method %q", fullMethod)
+	}
+	if method.IsStreamingClient() {
+		return nil, fmt.Errorf("%s streams requests, only unary and server streaming methods can be transcoded", fullMethod)
+	}
+	input := method.Input()
+	if body != "" && body != "*" {
+		field := findField(input, body)
+		if field == nil || field.Message() == nil || field.IsList() || field.IsMap() {
+			return nil, fmt.Errorf("body %q is not a message field of %s", body, input.FullName())
+		}
+	}
+	for _, param := range pathParams {
+		if _, err := fieldPath(input, param); err != nil {
+			return nil, fmt.Errorf("path parameter %q: %w", param, err)
+		}
+	}
+	return &transcoder{method: method, body: body}, nil
+}
+
+// findField looks a field up by its proto or JSON name.
+func findField(desc protoreflect.MessageDescriptor, name string) protoreflect.FieldDescriptor {
+	fields := desc.Fields()
+	if field := fields.ByName(protoreflect.Name(name)); field != nil {
+		return field
+	}
+	return fields.ByJSONName(name)
+}
+
+// fieldPath resolves a dotted path of fields, all messages but the last
+// one, which has to be a scalar, an enum or a list of them.
+func fieldPath(desc protoreflect.MessageDescriptor, path string) ([]protoreflect.FieldDescriptor, error) {
+	var res []protoreflect.FieldDescriptor
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		field := findField(desc, name)
+		switch {
+		case field == nil:
+			return nil, fmt.Errorf("%s has no field %s", desc.FullName(), name)
+		case field.IsMap():
+			return nil, fmt.Errorf("map field %s cannot be set from a parameter", field.FullName())
+		case i < len(names)-1 && (field.Message() == nil || field.IsList()):
+			return nil, fmt.Errorf("%s is not a message field", field.FullName())
+		case i == len(names)-1 && field.Message() != nil:
+			return nil, fmt.Errorf("message field %s cannot be set from a parameter", field.FullName())
+		}
+		res = append(res, field)
+		desc = field.Message()
+	}
+	return res, nil
+}
+
+// setField sets the field at path in m from the values of a parameter; a
+// single value field takes the last one.
+func setField(m protoreflect.Message, path string, values []string) error {
+	fields, err := fieldPath(m.Descriptor(), path)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields[:len(fields)-1] {
+		m = m.Mutable(field).Message()
+	}
+	field := fields[len(fields)-1]
+	if !field.IsList() {
+		values = values[len(values)-1:]
+	}
+	for _, value := range values {
+		v, err := parseFieldValue(field, value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", path, err)
+		}
+		if field.IsList() {
+			m.Mutable(field).List().Append(v)
+		} else {
+			m.Set(field, v)
+		}
+	}
+	return nil
+}
+
+func parseFieldValue(field protoreflect.FieldDescriptor, value string) (protoreflect.Value, error) {
+	switch field.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(value), nil
+	case protoreflect.BytesKind:
+		data, err := base64.StdEncoding.DecodeString(value)
+		return protoreflect.ValueOfBytes(data), err
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(value)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(value, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(value, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(value, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(value, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(value, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(value, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.EnumKind:
+		if v := field.Enum().Values().ByName(protoreflect.Name(value)); v != nil {
+			return protoreflect.ValueOfEnum(v.Number()), nil
+		}
+		v, err := strconv.ParseInt(value, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), err
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported field kind %s", field.Kind())
+}
+
+// isUser tells whether a message is a user, which the representations know
+// better than protojson.
+func isUser(desc protoreflect.MessageDescriptor) bool {
+	return desc.FullName() == (*pb.User)(nil).ProtoReflect().Descriptor().FullName()
+}
+
+// convertMessage copies a message into one of the same type but another
+// implementation, such as a dynamic message and its generated type.
+func convertMessage(from, to proto.Message) error {
+	data, err := proto.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, to)
+}
+
+// parseRequest builds the request message out of the body, the route
+// parameters and the query.
+func (t *transcoder) parseRequest(r *http.Request) (proto.Message, error) {
+	req := dynamicpb.NewMessage(t.method.Input())
+	if t.body != "" {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > 0 {
+			target := req.Interface()
+			if t.body != "*" {
+				target = req.Mutable(findField(t.method.Input(), t.body)).Message().Interface()
+			}
+			if isUser(target.ProtoReflect().Descriptor()) {
+				user, err := representationFromContext(r.Context()).parseUser(body)
+				if err == nil {
+					err = convertMessage(user, target)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("request body is not a valid user: %w", err)
+				}
+			} else if err := protojson.Unmarshal(body, target); err != nil {
+				return nil, fmt.Errorf("request body is not a valid %s: %w", target.ProtoReflect().Descriptor().FullName(), err)
+			}
+		}
+	}
+	// Route parameters win over the body.
+	params := chi.RouteContext(r.Context()).URLParams
+	for i, key := range params.Keys {
+		if err := setField(req, key, []string{params.Values[i]}); err != nil {
+			return nil, err
+		}
+	}
+	if t.body != "*" {
+		for key, values := range r.URL.Query() {
+			if err := setField(req, key, values); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return req, nil
+}
+
+// responseBody is the JSON of a response message in the representation of
+// the version.
+func responseBody(r *http.Request, msg proto.Message) (any, error) {
+	representation := representationFromContext(r.Context())
+	if isUser(msg.ProtoReflect().Descriptor()) {
+		var user pb.User
+		if err := convertMessage(msg, &user); err != nil {
+			return nil, err
+		}
+		return representation.user(&user), nil
+	}
+	data, err := representation.protoJSON().Marshal(msg)
+	return json.RawMessage(data), err
+}
+
+func (t *transcoder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := zerolog.Ctx(ctx)
+	req, err := t.parseRequest(r)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			bodyReadError(w, err)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	connection, err := createGrpcConnection(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("did not connect")
+		http.Error(w, "user service unavailable", http.StatusBadGateway)
+		return
+	}
+	defer connection.Close()
+	fullMethod := fmt.Sprintf("/%s/%s", t.method.Parent().FullName(), t.method.Name())
+
+	if !t.method.IsStreamingServer() {
+		resp := dynamicpb.NewMessage(t.method.Output())
+		if err := connection.Invoke(ctx, fullMethod, req, resp); err != nil {
+			logger.Error().Err(err).Msgf("%s failed", fullMethod)
+			http.Error(w, err.Error(), grpcStatusToHTTP(err))
+			return
+		}
+		body, err := responseBody(r, resp)
+		if err != nil {
+			logger.Error().Err(err).Msg("could not render response")
+			http.Error(w, "could not render response", http.StatusInternalServerError)
+			return
+		}
+		writeMessage(w, r, http.StatusOK, body, resp)
+		return
+	}
+
+	stream, err := connection.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, fullMethod)
+	if err == nil {
+		err = stream.SendMsg(req)
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), grpcStatusToHTTP(err))
+		return
+	}
+	// Wait for the first message so that errors can still change the
+	// status code.
+	msg := dynamicpb.NewMessage(t.method.Output())
+	err = stream.RecvMsg(msg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), grpcStatusToHTTP(err))
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeNDJSON)
+	encoder := json.NewEncoder(w)
+	controller := http.NewResponseController(w)
+	for count := 1; err == nil; count++ {
+		body, writeErr := responseBody(r, msg)
+		if writeErr == nil {
+			writeErr = encoder.Encode(body)
+		}
+		if writeErr != nil {
+			logger.Error().Err(writeErr).Msg("could not write streamed message")
+			return
+		}
+		controller.Flush()
+		msg = dynamicpb.NewMessage(t.method.Output())
+		if err = stream.RecvMsg(msg); err != nil && !errors.Is(err, io.EOF) {
+			// Headers are gone already: truncate the body so the client notices.
+			logger.Error().Err(err).Msgf("%s interrupted after %d messages", fullMethod, count)
+			return
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	pb "github.com/fcracker79/k8s-experiment/docker/rest/apigw/proto/user"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeCSV    = "text/csv"
+
+	// Exported users are flushed to the client every exportFlushInterval rows.
+	exportFlushInterval = 100
+)
+
+var conflictPolicies = map[string]pb.ConflictPolicy{
+	"":       pb.ConflictPolicy_CONFLICT_POLICY_UPSERT,
+	"upsert": pb.ConflictPolicy_CONFLICT_POLICY_UPSERT,
+	"skip":   pb.ConflictPolicy_CONFLICT_POLICY_SKIP,
+	"fail":   pb.ConflictPolicy_CONFLICT_POLICY_FAIL,
+}
+
+// userReader yields users from an upload, returning io.EOF once done.
+type userReader func() (*pb.User, error)
+
+func newNDJSONUserReader(r io.Reader, representation representation) userReader {
+	decoder := json.NewDecoder(r)
+	return func() (*pb.User, error) {
+		var line json.RawMessage
+		if err := decoder.Decode(&line); err != nil {
+			return nil, err
+		}
+		return representation.parseUser(line)
+	}
+}
+
+// newCSVUserReader reads the columns named by the representation, which may
+// come in any order as long as the header row names them.
+func newCSVUserReader(r io.Reader, representation representation) (userReader, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read CSV header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	names := representation.userCSVColumns()
+	if _, ok := columns[names[0]]; !ok {
+		return nil, fmt.Errorf("CSV header has no %s column", names[0])
+	}
+	reader.FieldsPerRecord = len(header)
+	return func() (*pb.User, error) {
+		record, err := reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return record[i]
+			}
+			return ""
+		}
+		return &pb.User{
+			Id:          field(names[0]),
+			Name:        field(names[1]),
+			Description: field(names[2]),
+			CreatedAt:   field(names[3]),
+			UpdatedAt:   field(names[4]),
+			CompanyId:   field(names[5]),
+		}, nil
+	}, nil
+}
+
+func grpcStatusToHTTP(err error) int {
+	switch status.Code(err) {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// importUsers streams an NDJSON or CSV upload to UserService.ImportUsers and
+// replies with the last progress acknowledgement. The import is not atomic:
+// when it fails the acknowledged batches stay imported, and the error tells
+// how many users of the upload they hold, so that only the others have to
+// be sent again.
+func importUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := zerolog.Ctx(ctx)
+	representation := representationFromContext(ctx)
+
+	policy, ok := conflictPolicies[r.URL.Query().Get("on_conflict")]
+	if !ok {
+		http.Error(w, "on_conflict must be one of upsert, skip, fail", http.StatusBadRequest)
+		return
+	}
+
+	var next userReader
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case contentTypeCSV:
+		reader, err := newCSVUserReader(r.Body, representation)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next = reader
+	case contentTypeNDJSON, "application/jsonl", "":
+		next = newNDJSONUserReader(r.Body, representation)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported content type %s", mediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	connection, err := createGrpcConnection(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("did not connect")
+		http.Error(w, "user service unavailable", http.StatusBadGateway)
+		return
+	}
+	defer connection.Close()
+	// Cancelling the stream drops the batch the user service is filling.
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := pb.NewUserServiceClient(connection).ImportUsers(streamCtx)
+	if err != nil {
+		http.Error(w, err.Error(), grpcStatusToHTTP(err))
+		return
+	}
+
+	// Acknowledgements are drained concurrently so the server never blocks
+	// on them while we are still uploading.
+	var last *pb.ImportUsersProgress
+	var recvErr error
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		for {
+			progress, err := stream.Recv()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					recvErr = err
+				}
+				return
+			}
+			last = progress
+		}
+	}()
+
+	var sent int64
+	fail := func(message string, status int) {
+		cancel()
+		<-received
+		imported := importedUsers(last)
+		logger.Error().Msgf("import failed after %d users, %d imported: %s", sent, imported, message)
+		http.Error(w, fmt.Sprintf("%s, the first %d users were imported", message, imported), status)
+	}
+	for {
+		user, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				fail(fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+				return
+			}
+			fail(fmt.Sprintf("could not parse user #%d: %v", sent+1, err), http.StatusBadRequest)
+			return
+		}
+		req := &pb.ImportUsersRequest{User: user}
+		if sent == 0 {
+			req.ConflictPolicy = policy
+		}
+		if err := stream.Send(req); err != nil {
+			// The server gave up, the actual error is reported by Recv.
+			break
+		}
+		sent++
+	}
+	stream.CloseSend()
+	<-received
+	if recvErr != nil {
+		fail(recvErr.Error(), grpcStatusToHTTP(recvErr))
+		return
+	}
+
+	data, _ := json.Marshal(representation.importProgress(last))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// importedUsers returns how many users of the upload the acknowledged
+// batches hold.
+func importedUsers(progress *pb.ImportUsersProgress) int64 {
+	if progress == nil {
+		return 0
+	}
+	return progress.Received
+}
+
+// exportUsers streams every user as NDJSON or, when asked for with
+// ?format=csv or Accept: text/csv, as CSV.
+func exportUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := zerolog.Ctx(ctx)
+	representation := representationFromContext(ctx)
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), contentTypeCSV) {
+		format = "csv"
+	}
+	if format != "" && format != "csv" && format != "ndjson" {
+		http.Error(w, "format must be one of ndjson, csv", http.StatusBadRequest)
+		return
+	}
+
+	connection, err := createGrpcConnection(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("did not connect")
+		http.Error(w, "user service unavailable", http.StatusBadGateway)
+		return
+	}
+	defer connection.Close()
+	stream, err := pb.NewUserServiceClient(connection).ExportUsers(ctx, &pb.ExportUsersRequest{})
+	if err != nil {
+		http.Error(w, err.Error(), grpcStatusToHTTP(err))
+		return
+	}
+	// Wait for the first user so that errors can still change the status code.
+	user, err := stream.Recv()
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), grpcStatusToHTTP(err))
+		return
+	}
+
+	var write func(*pb.User) error
+	var flush func()
+	if format == "csv" {
+		w.Header().Set("Content-Type", contentTypeCSV)
+		w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+		writer := csv.NewWriter(w)
+		writer.Write(representation.userCSVColumns())
+		write = func(u *pb.User) error {
+			return writer.Write([]string{u.Id, u.Name, u.Description, u.CreatedAt, u.UpdatedAt, u.CompanyId})
+		}
+		flush = writer.Flush
+	} else {
+		w.Header().Set("Content-Type", contentTypeNDJSON)
+		encoder := json.NewEncoder(w)
+		write = func(u *pb.User) error { return encoder.Encode(representation.user(u)) }
+		flush = func() {}
+	}
+	defer flush()
+
+	flusher, _ := w.(http.Flusher)
+	for count := 1; user != nil; count++ {
+		if err := write(user); err != nil {
+			logger.Error().Err(err).Msg("could not write exported user")
+			return
+		}
+		if count%exportFlushInterval == 0 && flusher != nil {
+			flush()
+			flusher.Flush()
+		}
+		user, err = stream.Recv()
+		if err != nil && !errors.Is(err, io.EOF) {
+			// Headers are gone already: truncate the body so the client notices.
+			logger.Error().Err(err).Msgf("export interrupted after %d users", count)
+			return
+		}
+	}
+}
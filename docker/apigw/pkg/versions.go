@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	// When v1, and the unversioned routes serving it, were deprecated and
+	// when they will be removed, as RFC 3339 times. Without
+	// API_V1_DEPRECATION v1 is not deprecated, without API_V1_SUNSET no
+	// removal is announced.
+	apiV1Deprecation = "API_V1_DEPRECATION"
+	apiV1Sunset      = "API_V1_SUNSET"
+)
+
+// apiVersion is a tree of the routes serving users and companies, mounted
+// under prefix.
+type apiVersion struct {
+	// Label of the version in the metrics.
+	name   string
+	prefix string
+	// Prefix of the routes replacing these ones, advertised to the clients
+	// of deprecated versions.
+	successor      string
+	representation representation
+	spec           []byte
+
+	deprecation time.Time
+	sunset      time.Time
+}
+
+type apiVersionKey struct{}
+
+// getAPIVersions returns the route trees, the unversioned one first. It
+// serves the v1 representations, since it is what clients used before
+// versioning.
+var getAPIVersions = sync.OnceValues(func() ([]*apiVersion, error) {
+	deprecation, err := parseAPIVersionTime(apiV1Deprecation)
+	if err != nil {
+		return nil, err
+	}
+	sunset, err := parseAPIVersionTime(apiV1Sunset)
+	if err != nil {
+		return nil, err
+	}
+	if !sunset.IsZero() && !deprecation.IsZero() && !sunset.After(deprecation) {
+		return nil, fmt.Errorf("%s must be after %s", apiV1Sunset, apiV1Deprecation)
+	}
+	return []*apiVersion{
+		{name: "unversioned", prefix: "", successor: "/v1", representation: v1Representation{}, spec: openAPISpec, deprecation: deprecation, sunset: sunset},
+		{name: "v1", prefix: "/v1", successor: "/v2", representation: v1Representation{}, spec: openAPISpec, deprecation: deprecation, sunset: sunset},
+		{name: "v2", prefix: "/v2", representation: v2Representation{}, spec: openAPISpecV2},
+	}, nil
+})
+
+func parseAPIVersionTime(env string) (time.Time, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %w", env, err)
+	}
+	return t, nil
+}
+
+// apiVersionFromContext returns the version serving the request. Requests
+// outside of the versioned trees, such as GraphQL ones, get the unversioned
+// one.
+func apiVersionFromContext(ctx context.Context) *apiVersion {
+	if v, ok := ctx.Value(apiVersionKey{}).(*apiVersion); ok {
+		return v
+	}
+	versions, _ := getAPIVersions()
+	return versions[0]
+}
+
+func representationFromContext(ctx context.Context) representation {
+	return apiVersionFromContext(ctx).representation
+}
+
+// resourcePath returns the path of a resource in the version serving the
+// request, e.g. /v2/users/user1.
+func resourcePath(ctx context.Context, collection, id string) string {
+	return apiVersionFromContext(ctx).prefix + "/" + collection + "/" + id
+}
+
+// routePattern returns the pattern of the route serving r without its
+// version prefix, so that rate and body limits apply to every version of a
+// route.
+func routePattern(r *http.Request) string {
+	return unversionedPath(chi.RouteContext(r.Context()).RoutePattern())
+}
+
+// unversionedPath returns a path or a pattern without its version prefix,
+// e.g. /users/{id} for /v2/users/{id}.
+func unversionedPath(path string) string {
+	versions, _ := getAPIVersions()
+	for _, v := range versions {
+		if rest, found := strings.CutPrefix(path, v.prefix); v.prefix != "" && found && strings.HasPrefix(rest, "/") {
+			return rest
+		}
+	}
+	return path
+}
+
+// Middleware stores the version in the request context, announces its
+// deprecation and counts its requests. It has to run once the route is
+// matched.
+func (v *apiVersion) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !v.deprecation.IsZero() {
+			// RFC 9745 and RFC 8594.
+			w.Header().Set("Deprecation", "@"+strconv.FormatInt(v.deprecation.Unix(), 10))
+			if v.successor != "" {
+				w.Header().Add("Link", fmt.Sprintf(`<%s%s>; rel="successor-version"`, v.successor, strings.TrimPrefix(r.URL.Path, v.prefix)))
+			}
+		}
+		if !v.sunset.IsZero() {
+			w.Header().Set("Sunset", v.sunset.UTC().Format(http.TimeFormat))
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, v)))
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		apiRequests.WithLabelValues(v.name, r.Method+" "+routePattern(r), strconv.Itoa(status)).Inc()
+	})
+}
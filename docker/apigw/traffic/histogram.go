@@ -0,0 +1,126 @@
+package traffic
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// Values below this many microseconds have a bucket each, the larger ones
+// share buckets of subBuckets values per power of two.
+const (
+	exactBuckets = 256
+	subBuckets   = 128
+)
+
+// Histogram counts latencies with a relative error under 1%, in the manner
+// of HdrHistogram: buckets are microseconds up to 256µs, then 128 buckets
+// per power of two. The zero value is ready to use; it is not safe for
+// concurrent use.
+type Histogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+func bucketIndex(d time.Duration) int {
+	v := uint64(max(d.Microseconds(), 0))
+	if v < exactBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - 8
+	return exactBuckets + (shift-1)*subBuckets + int(v>>shift) - subBuckets
+}
+
+// bucketValue returns the middle of the values of a bucket.
+func bucketValue(i int) time.Duration {
+	if i < exactBuckets {
+		return time.Duration(i) * time.Microsecond
+	}
+	shift := (i-exactBuckets)/subBuckets + 1
+	low := uint64((i-exactBuckets)%subBuckets+subBuckets) << shift
+	return time.Duration(low+(uint64(1)<<shift)/2) * time.Microsecond
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	i := bucketIndex(d)
+	if i >= len(h.counts) {
+		h.counts = append(h.counts, make([]uint64, i+1-len(h.counts))...)
+	}
+	h.counts[i]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	h.max = max(h.max, d)
+	h.count++
+	h.sum += d
+}
+
+// Merge adds the latencies of other.
+func (h *Histogram) Merge(other *Histogram) {
+	if other.count == 0 {
+		return
+	}
+	if len(other.counts) > len(h.counts) {
+		h.counts = append(h.counts, make([]uint64, len(other.counts)-len(h.counts))...)
+	}
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	if h.count == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	h.max = max(h.max, other.max)
+	h.count += other.count
+	h.sum += other.sum
+}
+
+func (h *Histogram) Count() uint64      { return h.count }
+func (h *Histogram) Min() time.Duration { return h.min }
+func (h *Histogram) Max() time.Duration { return h.max }
+
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Percentile returns the latency under which p percent of the requests
+// completed, e.g. Percentile(99).
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	// The smallest number of requests covering p percent of them.
+	rank := uint64(math.Ceil(p * float64(h.count) / 100))
+	rank = min(max(rank, 1), h.count)
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			return min(max(bucketValue(i), h.min), h.max)
+		}
+	}
+	return h.max
+}
+
+// Distribution counts the requests completed under each bound, the last
+// count being the ones above the last bound.
+func (h *Histogram) Distribution(bounds []time.Duration) []uint64 {
+	res := make([]uint64, len(bounds)+1)
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		v := bucketValue(i)
+		j := 0
+		for j < len(bounds) && v >= bounds[j] {
+			j++
+		}
+		res[j] += c
+	}
+	return res
+}
@@ -0,0 +1,81 @@
+package traffic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketIndex(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want int
+	}{
+		{-time.Millisecond, 0},
+		{0, 0},
+		{255 * time.Microsecond, 255},
+		{256 * time.Microsecond, 256},
+		{257 * time.Microsecond, 256},
+		{258 * time.Microsecond, 257},
+		{511 * time.Microsecond, 383},
+		{512 * time.Microsecond, 384},
+		{time.Second, 1780},
+	} {
+		if got := bucketIndex(tc.d); got != tc.want {
+			t.Errorf("bucketIndex(%v) = %d, want %d", tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestBucketValue(t *testing.T) {
+	for i := 0; i < bucketIndex(100*time.Millisecond); i++ {
+		v := bucketValue(i)
+		if got := bucketIndex(v); got != i {
+			t.Fatalf("bucketIndex(bucketValue(%d) = %v) = %d", i, v, got)
+		}
+		// Within 1% of every value of the bucket.
+		low, high := v, v
+		for bucketIndex(low-time.Microsecond) == i && low > 0 {
+			low -= time.Microsecond
+		}
+		for bucketIndex(high+time.Microsecond) == i {
+			high += time.Microsecond
+		}
+		if float64(high-low) > float64(low)/50 {
+			t.Fatalf("bucket %d covers %v to %v", i, low, high)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var h Histogram
+	for i := 1; i <= 150; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	for _, tc := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, 1 * time.Microsecond},
+		{1, 2 * time.Microsecond},
+		{50, 75 * time.Microsecond},
+		{99, 149 * time.Microsecond},
+		{99.9, 150 * time.Microsecond},
+		{100, 150 * time.Microsecond},
+	} {
+		if got := h.Percentile(tc.p); got != tc.want {
+			t.Errorf("Percentile(%v) = %v, want %v", tc.p, got, tc.want)
+		}
+	}
+
+	var empty Histogram
+	if got := empty.Percentile(99); got != 0 {
+		t.Errorf("Percentile(99) of no request = %v, want 0", got)
+	}
+
+	// Clamped to the recorded values rather than the middle of the bucket.
+	var one Histogram
+	one.Record(time.Second)
+	if got := one.Percentile(50); got != time.Second {
+		t.Errorf("Percentile(50) of 1s = %v, want 1s", got)
+	}
+}
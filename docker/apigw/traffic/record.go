@@ -0,0 +1,108 @@
+// Package traffic reads and writes the recordings of the gateway traffic and
+// reports the latencies and errors of the requests replayed or generated
+// against a gateway.
+package traffic
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Version of the recording format.
+const Version = 1
+
+// Header is the first line of a recording.
+type Header struct {
+	Version int       `json:"version"`
+	Started time.Time `json:"started"`
+}
+
+// Record is a request of a recording, with the response it got.
+type Record struct {
+	// Time of the request since the start of the recording.
+	Offset time.Duration `json:"t"`
+	Method string        `json:"m"`
+	// Path and query of the request.
+	URI string `json:"u"`
+	// Route pattern that served the request, e.g. /v1/users/{id}.
+	Route  string            `json:"r,omitempty"`
+	Header map[string]string `json:"h,omitempty"`
+	Body   []byte            `json:"b,omitempty"`
+	// The body was longer and is cut.
+	Truncated bool          `json:"x,omitempty"`
+	Status    int           `json:"s"`
+	Duration  time.Duration `json:"d"`
+}
+
+// Writer writes a recording: gzipped JSON lines, a Header then a Record per
+// request.
+type Writer struct {
+	gzip    *gzip.Writer
+	encoder *json.Encoder
+}
+
+func NewWriter(w io.Writer, started time.Time) (*Writer, error) {
+	gz := gzip.NewWriter(w)
+	encoder := json.NewEncoder(gz)
+	if err := encoder.Encode(&Header{Version: Version, Started: started}); err != nil {
+		return nil, err
+	}
+	return &Writer{gzip: gz, encoder: encoder}, nil
+}
+
+func (w *Writer) Write(record *Record) error {
+	return w.encoder.Encode(record)
+}
+
+// Flush makes the records written so far readable, e.g. while the gateway
+// is still recording.
+func (w *Writer) Flush() error {
+	return w.gzip.Flush()
+}
+
+// Close ends the recording without closing the underlying writer.
+func (w *Writer) Close() error {
+	return w.gzip.Close()
+}
+
+// Reader reads a recording written by a Writer.
+type Reader struct {
+	Header  Header
+	decoder *json.Decoder
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(gz)
+	var header Header
+	if err := decoder.Decode(&header); err != nil {
+		return nil, fmt.Errorf("invalid recording header: %w", err)
+	}
+	if header.Version != Version {
+		return nil, fmt.Errorf("unsupported recording version %d", header.Version)
+	}
+	return &Reader{Header: header, decoder: decoder}, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the recording.
+// Recordings cut while the gateway was writing them end at the last
+// complete record.
+func (r *Reader) Next() (*Record, error) {
+	var record Record
+	err := r.decoder.Decode(&record)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
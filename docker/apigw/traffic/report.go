@@ -0,0 +1,257 @@
+package traffic
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Bounds of the latency distribution printed by a Report.
+var distributionBounds = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second,
+}
+
+// OperationStats are the results of the requests of an operation.
+type OperationStats struct {
+	Latency Histogram
+	// Failed requests by reason: the status of the responses from 400 up,
+	// or the kind of error of the requests without a response.
+	Errors map[string]uint64
+}
+
+func (s *OperationStats) failures() uint64 {
+	var res uint64
+	for _, c := range s.Errors {
+		res += c
+	}
+	return res
+}
+
+// Report collects the latencies and the errors of requests by operation,
+// e.g. "GET /v1/users/{id}". It is safe for concurrent use.
+type Report struct {
+	mu         sync.Mutex
+	started    time.Time
+	elapsed    time.Duration
+	operations map[string]*OperationStats
+}
+
+func NewReport() *Report {
+	return &Report{started: time.Now(), operations: make(map[string]*OperationStats)}
+}
+
+// Add records a request, err being the error of a request without a
+// response, or a Failure.
+func (r *Report) Add(operation string, status int, err error, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.operations[operation]
+	if !ok {
+		s = &OperationStats{Errors: make(map[string]uint64)}
+		r.operations[operation] = s
+	}
+	s.Latency.Record(latency)
+	switch {
+	case err != nil:
+		s.Errors[errorKind(err)]++
+	case status >= 400:
+		s.Errors[fmt.Sprintf("%d %s", status, http.StatusText(status))]++
+	}
+}
+
+// Stop ends the measured period, the report rates are computed over it.
+func (r *Report) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.elapsed = time.Since(r.started)
+}
+
+func (r *Report) duration() time.Duration {
+	if r.elapsed > 0 {
+		return r.elapsed
+	}
+	return time.Since(r.started)
+}
+
+// Failure is the error of a request whose response is not the expected
+// one, reported by its text.
+type Failure string
+
+func (f Failure) Error() string {
+	return string(f)
+}
+
+// errorKind classifies the errors of the requests without a response.
+func errorKind(err error) string {
+	var failure Failure
+	var netErr net.Error
+	switch {
+	case errors.As(err, &failure):
+		return string(failure)
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection closed"
+	case strings.Contains(err.Error(), "connection refused"):
+		return "connection refused"
+	case strings.Contains(err.Error(), "connection reset"):
+		return "connection reset"
+	}
+	return "error"
+}
+
+func (r *Report) names() []string {
+	res := make([]string, 0, len(r.operations))
+	for name := range r.operations {
+		res = append(res, name)
+	}
+	slices.Sort(res)
+	return res
+}
+
+// total merges the statistics of all the operations.
+func (r *Report) total() *OperationStats {
+	res := &OperationStats{Errors: make(map[string]uint64)}
+	for _, s := range r.operations {
+		res.Latency.Merge(&s.Latency)
+		for kind, c := range s.Errors {
+			res.Errors[kind] += c
+		}
+	}
+	return res
+}
+
+// Print writes the statistics of every operation and of all of them, the
+// latency distribution of all the requests and the errors.
+func (r *Report) Print(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names, total := r.names(), r.total()
+	seconds := r.duration().Seconds()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "operation\trequests\terrors\treq/s\tmean\tp50\tp90\tp99\tp99.9\tmax\t")
+	row := func(name string, s *OperationStats) {
+		h := &s.Latency
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t%s\t%s\t\n", name, h.Count(), s.failures(), float64(h.Count())/seconds,
+			round(h.Mean()), round(h.Percentile(50)), round(h.Percentile(90)), round(h.Percentile(99)), round(h.Percentile(99.9)), round(h.Max()))
+	}
+	for _, name := range names {
+		row(name, r.operations[name])
+	}
+	row("all", total)
+	tw.Flush()
+
+	if total.Latency.Count() > 0 {
+		fmt.Fprintln(w, "\nlatency distribution")
+		counts := total.Latency.Distribution(distributionBounds)
+		peak := slices.Max(counts)
+		for i, c := range counts {
+			label := "> " + distributionBounds[len(distributionBounds)-1].String()
+			if i < len(distributionBounds) {
+				label = "< " + distributionBounds[i].String()
+			}
+			bar := strings.Repeat("#", int(c*50/max(peak, 1)))
+			fmt.Fprintf(w, "%8s %6.2f%% %s\n", label, float64(c)*100/float64(total.Latency.Count()), bar)
+		}
+	}
+
+	if len(total.Errors) > 0 {
+		fmt.Fprintln(w, "\nerrors")
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, name := range names {
+			s := r.operations[name]
+			kinds := make([]string, 0, len(s.Errors))
+			for kind := range s.Errors {
+				kinds = append(kinds, kind)
+			}
+			slices.Sort(kinds)
+			for _, kind := range kinds {
+				fmt.Fprintf(tw, "%s\t%s\t%d\n", name, kind, s.Errors[kind])
+			}
+		}
+		tw.Flush()
+	}
+}
+
+// Summary is the outcome of a Report, meant to be compared across runs.
+type Summary struct {
+	Started time.Time `json:"started"`
+	// Seconds of the measured period.
+	Duration   float64                      `json:"duration_seconds"`
+	Operations map[string]*OperationSummary `json:"operations"`
+	All        *OperationSummary            `json:"all"`
+}
+
+// OperationSummary are the results of the requests of an operation, the
+// latencies in milliseconds.
+type OperationSummary struct {
+	Requests uint64             `json:"requests"`
+	Failures uint64             `json:"errors"`
+	Rate     float64            `json:"requests_per_second"`
+	Latency  map[string]float64 `json:"latency_ms"`
+	Errors   map[string]uint64  `json:"errors_by_kind,omitempty"`
+}
+
+// Percentiles of the latencies of a Summary.
+var summaryPercentiles = []float64{50, 75, 90, 95, 99, 99.9, 99.99}
+
+func (r *Report) Summary() *Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seconds := r.duration().Seconds()
+	res := &Summary{
+		Started:    r.started,
+		Duration:   seconds,
+		Operations: make(map[string]*OperationSummary, len(r.operations)),
+		All:        summarize(r.total(), seconds),
+	}
+	for name, s := range r.operations {
+		res.Operations[name] = summarize(s, seconds)
+	}
+	return res
+}
+
+func summarize(s *OperationStats, seconds float64) *OperationSummary {
+	h := &s.Latency
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	res := &OperationSummary{
+		Requests: h.Count(),
+		Failures: s.failures(),
+		Rate:     float64(h.Count()) / seconds,
+		Latency:  map[string]float64{"min": ms(h.Min()), "mean": ms(h.Mean()), "max": ms(h.Max())},
+	}
+	for _, p := range summaryPercentiles {
+		res.Latency["p"+strconv.FormatFloat(p, 'f', -1, 64)] = ms(h.Percentile(p))
+	}
+	if len(s.Errors) > 0 {
+		res.Errors = maps.Clone(s.Errors)
+	}
+	return res
+}
+
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/admin"
+	"google.golang.org/grpc/reflection"
+	v1reflectiongrpc "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	v1alphareflectiongrpc "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+// Port of the admin gRPC server. When not set the admin server is not
+// started.
+const adminTCPPort = "ADMIN_TCP_PORT"
+
+// servicesInfo merges the services of several servers, so that reflection on
+// the admin server also describes the services of the main one.
+type servicesInfo []reflection.ServiceInfoProvider
+
+func (p servicesInfo) GetServiceInfo() map[string]grpc.ServiceInfo {
+	res := make(map[string]grpc.ServiceInfo)
+	for _, provider := range p {
+		for name, info := range provider.GetServiceInfo() {
+			res[name] = info
+		}
+	}
+	return res
+}
+
+// startAdminServer serves reflection, channelz and the other grpc admin
+// services on ADMIN_TCP_PORT, so that grpcurl and grpcdebug can be pointed at
+// it without exposing them on the main port. The returned function stops the
+// admin server.
+func startAdminServer(main *grpc.Server) (func(), error) {
+	port, exists := os.LookupEnv(adminTCPPort)
+	if !exists {
+		return func() {}, nil
+	}
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on admin port: %w", err)
+	}
+
+	s := grpc.NewServer()
+	cleanup, err := admin.Register(s)
+	if err != nil {
+		lis.Close()
+		return nil, fmt.Errorf("failed to register admin services: %w", err)
+	}
+	opts := reflection.ServerOptions{Services: servicesInfo{main, s}}
+	v1reflectiongrpc.RegisterServerReflectionServer(s, reflection.NewServerV1(opts))
+	v1alphareflectiongrpc.RegisterServerReflectionServer(s, reflection.NewServer(opts))
+
+	go func() {
+		log.Printf("Admin server listening on port %s", port)
+		if err := s.Serve(lis); err != nil {
+			log.Error().Err(err).Msg("admin server stopped")
+		}
+	}()
+	return func() {
+		s.Stop()
+		cleanup()
+	}, nil
+}
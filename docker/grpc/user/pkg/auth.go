@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Path of the JSON file describing the callers allowed to use UserService
+// and the per-method policies. When not set every call is accepted.
+const grpcAuthConfig = "GRPC_AUTH_CONFIG"
+
+// Audience of the service identity tokens accepted by UserService.
+const serviceTokenAudience = "user-service"
+
+// Metadata key carrying the end user on whose behalf a trusted caller, such
+// as the gateway, is calling.
+const subjectMetadataKey = "x-auth-subject"
+
+// serviceCredentials are the ways a caller can prove its identity: a static
+// bearer token, an HS256 token whose subject is the caller name, signed
+// with the base64 encoded key, or, when the server requires mTLS, the SPIFFE
+// ID of its client certificate.
+type serviceCredentials struct {
+	Token    string `json:"token"`
+	Key      string `json:"key"`
+	SPIFFEID string `json:"spiffe_id"`
+}
+
+// authConfig is the content of GRPC_AUTH_CONFIG, e.g.
+//
+//	{
+//	  "services": {
+//	    "apigw": {"key": "c2VjcmV0"},
+//	    "async-user": {"token": "s3cr3t"},
+//	    "debug": {"spiffe_id": "spiffe://k8s-experiment/ns/k8s-experiment/sa/debug"}
+//	  },
+//	  "policies": {
+//	    "DeleteUser": ["apigw", "async-user"],
+//	    "*": ["apigw", "async-user"]
+//	  }
+//	}
+//
+// Policies are keyed by method name, "*" applies to the methods not listed.
+// Methods without any policy are open to every authenticated caller.
+type authConfig struct {
+	Services map[string]serviceCredentials `json:"services"`
+	Policies map[string][]string           `json:"policies"`
+}
+
+type serviceAuthenticator struct {
+	tokens   map[string]string
+	keys     map[string][]byte
+	spiffe   map[string]string
+	policies map[string]map[string]bool
+	parser   *jwt.Parser
+}
+
+// newServiceAuthenticator loads GRPC_AUTH_CONFIG. It returns nil when
+// authentication is disabled.
+func newServiceAuthenticator() (*serviceAuthenticator, error) {
+	path, exists := os.LookupEnv(grpcAuthConfig)
+	if !exists {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", grpcAuthConfig, err)
+	}
+	var config authConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", grpcAuthConfig, err)
+	}
+
+	a := &serviceAuthenticator{
+		tokens:   make(map[string]string),
+		keys:     make(map[string][]byte),
+		spiffe:   make(map[string]string),
+		policies: make(map[string]map[string]bool),
+		parser: jwt.NewParser(
+			jwt.WithValidMethods([]string{"HS256"}),
+			jwt.WithAudience(serviceTokenAudience),
+			jwt.WithExpirationRequired(),
+			jwt.WithLeeway(30*time.Second),
+		),
+	}
+	for name, credentials := range config.Services {
+		if credentials.Token != "" {
+			a.tokens[credentials.Token] = name
+		}
+		if credentials.Key != "" {
+			key, err := base64.StdEncoding.DecodeString(credentials.Key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key for service %s: %w", name, err)
+			}
+			a.keys[name] = key
+		}
+		if credentials.SPIFFEID != "" {
+			a.spiffe[credentials.SPIFFEID] = name
+		}
+	}
+	for method, callers := range config.Policies {
+		allowed := make(map[string]bool, len(callers))
+		for _, caller := range callers {
+			allowed[caller] = true
+		}
+		a.policies[method] = allowed
+	}
+	return a, nil
+}
+
+// peerSPIFFEID returns the SPIFFE ID of the client certificate, already
+// verified during the handshake.
+func peerSPIFFEID(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return "", false
+	}
+	id, err := spiffeID(info.State.PeerCertificates[0])
+	return id, err == nil
+}
+
+// authenticate returns the name of the caller identified by the bearer token
+// in the incoming metadata or, failing that, by its client certificate.
+func (a *serviceAuthenticator) authenticate(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		if id, ok := peerSPIFFEID(ctx); ok {
+			if name, ok := a.spiffe[id]; ok {
+				return name, nil
+			}
+		}
+		return "", status.Error(codes.Unauthenticated, "missing credentials")
+	}
+	scheme, token, found := strings.Cut(values[0], " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", status.Error(codes.Unauthenticated, "expected a bearer token")
+	}
+	token = strings.TrimSpace(token)
+
+	for known, name := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			return name, nil
+		}
+	}
+
+	claims := jwt.RegisteredClaims{}
+	_, err := a.parser.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		key, ok := a.keys[claims.Subject]
+		if !ok {
+			return nil, fmt.Errorf("unknown service %q", claims.Subject)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return "", status.Errorf(codes.Unauthenticated, "invalid credentials: %v", err)
+	}
+	return claims.Subject, nil
+}
+
+func (a *serviceAuthenticator) authorize(caller, fullMethod string) error {
+	_, method := splitMethodName(fullMethod)
+	allowed, ok := a.policies[method]
+	if !ok {
+		allowed, ok = a.policies["*"]
+	}
+	if ok && !allowed[caller] {
+		return status.Errorf(codes.PermissionDenied, "%s may not call %s", caller, method)
+	}
+	return nil
+}
+
+func (a *serviceAuthenticator) check(ctx context.Context, fullMethod string) (context.Context, error) {
+	caller, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	logCtx := zerolog.Ctx(ctx).With().Str("caller", caller)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if subject := md.Get(subjectMetadataKey); len(subject) > 0 {
+			logCtx = logCtx.Str("subject", subject[0])
+		}
+	}
+	logger := logCtx.Logger()
+	ctx = logger.WithContext(ctx)
+	if err := a.authorize(caller, fullMethod); err != nil {
+		logger.Warn().Msg(err.Error())
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func unaryAuthInterceptor(a *serviceAuthenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := a.check(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func streamAuthInterceptor(a *serviceAuthenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.check(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
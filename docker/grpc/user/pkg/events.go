@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	pb "github.com/fcracker79/k8s-experiment/docker/grpc/user/proto"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// NATS server the change events are published to. When not set no event
+	// is published.
+	natsUrl = "NATS_URL"
+	// Subjects of the events are this prefix followed by the event type, e.g.
+	// k8s.experiment.users.events.deleted.
+	natsUserEventsSubject = "NATS_USER_EVENTS_SUBJECT"
+)
+
+const (
+	userCreated = "created"
+	userUpdated = "updated"
+	userDeleted = "deleted"
+)
+
+// userEvent is the JSON payload of a change event. User is not set for
+// deletions.
+type userEvent struct {
+	Type string    `json:"type"`
+	ID   string    `json:"id"`
+	User *pb.User  `json:"user,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// eventPublisher publishes user change events, so that caches and other
+// services can react to them.
+type eventPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// newEventPublisher connects to NATS_URL. It returns nil when events are
+// disabled.
+func newEventPublisher() (*eventPublisher, error) {
+	url, exists := os.LookupEnv(natsUrl)
+	if !exists {
+		return nil, nil
+	}
+	subject, err := getEnvStringOrError(natsUserEventsSubject)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to NATS: %w", err)
+	}
+	return &eventPublisher{conn: conn, subject: subject}, nil
+}
+
+// publish sends an event without waiting for NATS, failures are only
+// logged: the change is already committed.
+func (p *eventPublisher) publish(ctx context.Context, eventType, id string, user *pb.User) {
+	if p == nil {
+		return
+	}
+	data, err := json.Marshal(userEvent{Type: eventType, ID: id, User: user, Time: time.Now().UTC()})
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("could not marshal user event")
+		return
+	}
+	header := make(nats.Header)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+	if id := requestIDFromContext(ctx); id != "" {
+		header.Set(requestIDHeader, id)
+	}
+	msg := &nats.Msg{
+		Subject: p.subject + "." + eventType,
+		Data:    data,
+		Header:  header,
+	}
+	if err := p.conn.PublishMsg(msg); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("could not publish %s event for user %s", eventType, id)
+	}
+}
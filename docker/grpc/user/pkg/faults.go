@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Port of the HTTP server managing the injected faults on /faults. When not
+// set no fault can be injected.
+const faultsAdminTCPPort = "FAULTS_ADMIN_TCP_PORT"
+
+// duration is a time.Duration read from JSON strings such as "250ms".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// faultMatch selects the calls a fault applies to. Empty fields match any
+// call.
+type faultMatch struct {
+	// Method name without the service, e.g. GetUser.
+	Method string `json:"method,omitempty"`
+	// Metadata values the call must have, * for any value.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// faultRule injects a fault in a share of the calls it matches.
+type faultRule struct {
+	Match faultMatch `json:"match"`
+	// Percentage of the matched calls affected, all of them when not
+	// set. 0 pauses the rule.
+	Percent *float64 `json:"percent,omitempty"`
+	// Latency added before the call is served or failed.
+	Delay duration `json:"delay,omitempty"`
+	// Status code returned instead of serving the call, e.g. UNAVAILABLE.
+	Code string `json:"code,omitempty"`
+	// Never answer the call, until its deadline expires or it is
+	// cancelled.
+	Drop bool `json:"drop,omitempty"`
+
+	code codes.Code
+}
+
+type faultRules struct {
+	Rules []*faultRule `json:"rules"`
+}
+
+func (f *faultRule) validate() error {
+	if f.Percent != nil && (*f.Percent < 0 || *f.Percent > 100) {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	if f.Delay < 0 {
+		return fmt.Errorf("delay must not be negative")
+	}
+	if f.Code != "" {
+		if err := f.code.UnmarshalJSON([]byte(strconv.Quote(f.Code))); err != nil {
+			return err
+		}
+		if f.code == codes.OK {
+			return fmt.Errorf("code must be an error code")
+		}
+	}
+	if f.Code != "" && f.Drop {
+		return fmt.Errorf("a fault either returns a code or drops the call")
+	}
+	if f.Delay == 0 && f.Code == "" && !f.Drop {
+		return fmt.Errorf("no fault to inject")
+	}
+	return nil
+}
+
+// hit tells whether the rule applies to one of the calls it matches.
+func (f *faultRule) hit() bool {
+	return f.Percent == nil || rand.Float64()*100 < *f.Percent
+}
+
+func (f *faultRule) matches(ctx context.Context, fullMethod string) bool {
+	if _, method := splitMethodName(fullMethod); f.Match.Method != "" && f.Match.Method != method {
+		return false
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for name, value := range f.Match.Headers {
+		values := md.Get(name)
+		if len(values) == 0 || (value != "*" && value != values[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// faultInjector adds latency, errors and unanswered calls to the RPCs, for
+// chaos experiments. Its rules are replaced at runtime through the admin
+// server.
+type faultInjector struct {
+	rules atomic.Pointer[faultRules]
+}
+
+// newFaultInjector starts the admin server of the faults on
+// FAULTS_ADMIN_TCP_PORT, returning nil when it is not set.
+func newFaultInjector() *faultInjector {
+	port, exists := os.LookupEnv(faultsAdminTCPPort)
+	if !exists {
+		return nil
+	}
+	f := &faultInjector{}
+	f.rules.Store(&faultRules{Rules: []*faultRule{}})
+	mux := http.NewServeMux()
+	mux.Handle("/faults", f)
+	go func() {
+		log.Printf("Faults admin server listening on port %s", port)
+		if err := http.ListenAndServe(fmt.Sprintf(":%s", port), mux); err != nil {
+			log.Error().Err(err).Msg("faults admin server stopped")
+		}
+	}()
+	return f
+}
+
+// ServeHTTP lists the rules on GET, replaces them with the ones of the body
+// on PUT and removes them on DELETE.
+func (f *faultInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var rules faultRules
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i, rule := range rules.Rules {
+			if err := rule.validate(); err != nil {
+				http.Error(w, fmt.Sprintf("rule %d: %v", i, err), http.StatusBadRequest)
+				return
+			}
+		}
+		f.rules.Store(&rules)
+		log.Warn().Int("rules", len(rules.Rules)).Msg("fault rules replaced")
+	case http.MethodDelete:
+		f.rules.Store(&faultRules{Rules: []*faultRule{}})
+		log.Warn().Msg("fault rules removed")
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.rules.Load())
+}
+
+// inject applies the first rule matching a call, unless its percentage
+// misses. A nil error lets the call be served.
+func (f *faultInjector) inject(ctx context.Context, fullMethod string) error {
+	var rule *faultRule
+	for _, r := range f.rules.Load().Rules {
+		if r.matches(ctx, fullMethod) {
+			rule = r
+			break
+		}
+	}
+	if rule == nil || !rule.hit() {
+		return nil
+	}
+	_, method := splitMethodName(fullMethod)
+	logger := zerolog.Ctx(ctx)
+	if rule.Delay > 0 {
+		faultsInjected.WithLabelValues(method, "delay").Inc()
+		logger.Warn().Dur("delay", time.Duration(rule.Delay)).Msg("fault injected: delaying the call")
+		select {
+		case <-time.After(time.Duration(rule.Delay)):
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	switch {
+	case rule.Drop:
+		faultsInjected.WithLabelValues(method, "drop").Inc()
+		logger.Warn().Msg("fault injected: dropping the call")
+		<-ctx.Done()
+		return status.FromContextError(ctx.Err()).Err()
+	case rule.Code != "":
+		faultsInjected.WithLabelValues(method, "code").Inc()
+		logger.Warn().Stringer("code", rule.code).Msg("fault injected: failing the call")
+		return status.Error(rule.code, "fault injected")
+	}
+	return nil
+}
+
+// unaryFaultInterceptor has to run after the deadlines are applied, so that
+// dropped calls end.
+func (f *faultInjector) unaryFaultInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := f.inject(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (f *faultInjector) streamFaultInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := f.inject(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Comma separated list of method=timeout overriding the default deadlines,
+// e.g. "GetUser=500ms,ImportUsers=30m".
+const grpcMethodTimeouts = "GRPC_METHOD_TIMEOUTS"
+
+const defaultMethodTimeout = 5 * time.Second
+
+// Deadlines applied to calls that come without one, or with a later one.
+// Methods are keyed by name, without the service.
+var defaultMethodTimeouts = map[string]time.Duration{
+	"ImportUsers": 30 * time.Minute,
+	"ExportUsers": 30 * time.Minute,
+}
+
+// newServerInterceptors returns the unary and stream interceptor chains of the
+// user service: metrics, access logs, panic recovery, authentication,
+// deadlines, fault injection and request validation, outermost first.
+func newServerInterceptors() ([]grpc.UnaryServerInterceptor, []grpc.StreamServerInterceptor, error) {
+	timeouts, err := loadMethodTimeouts()
+	if err != nil {
+		return nil, nil, err
+	}
+	auth, err := newServiceAuthenticator()
+	if err != nil {
+		return nil, nil, err
+	}
+	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+	unary := []grpc.UnaryServerInterceptor{
+		unaryMetricsInterceptor,
+		unaryAccessLogInterceptor(logger),
+		unaryRecoveryInterceptor,
+	}
+	stream := []grpc.StreamServerInterceptor{
+		streamMetricsInterceptor,
+		streamAccessLogInterceptor(logger),
+		streamRecoveryInterceptor,
+	}
+	if auth != nil {
+		unary = append(unary, unaryAuthInterceptor(auth))
+		stream = append(stream, streamAuthInterceptor(auth))
+	} else {
+		logger.Warn().Msgf("%s not set, authentication is disabled", grpcAuthConfig)
+	}
+	unary = append(unary, unaryDeadlineInterceptor(timeouts))
+	stream = append(stream, streamDeadlineInterceptor(timeouts))
+	if faults := newFaultInjector(); faults != nil {
+		unary = append(unary, faults.unaryFaultInterceptor)
+		stream = append(stream, faults.streamFaultInterceptor)
+	}
+	unary = append(unary, unaryValidationInterceptor)
+	stream = append(stream, streamValidationInterceptor)
+	return unary, stream, nil
+}
+
+func loadMethodTimeouts() (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration, len(defaultMethodTimeouts))
+	for method, timeout := range defaultMethodTimeouts {
+		timeouts[method] = timeout
+	}
+	value, exists := os.LookupEnv(grpcMethodTimeouts)
+	if !exists || value == "" {
+		return timeouts, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		method, rawTimeout, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			return nil, fmt.Errorf("%s: invalid entry %q", grpcMethodTimeouts, entry)
+		}
+		timeout, err := time.ParseDuration(rawTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid timeout for %s: %w", grpcMethodTimeouts, method, err)
+		}
+		timeouts[method] = timeout
+	}
+	return timeouts, nil
+}
+
+// splitMethodName splits "/user.UserService/GetUser" into its service and
+// method.
+func splitMethodName(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", fullMethod
+}
+
+// wrappedServerStream replaces the context of a grpc.ServerStream.
+type wrappedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *wrappedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// requestLogger returns a child of logger carrying the call's request id,
+// method, peer and trace.
+func requestLogger(ctx context.Context, logger zerolog.Logger, fullMethod string) zerolog.Logger {
+	logCtx := logger.With().Str("requestId", requestIDFromContext(ctx)).Str("method", fullMethod)
+	if p, ok := peer.FromContext(ctx); ok {
+		logCtx = logCtx.Str("peer", p.Addr.String())
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		logCtx = logCtx.
+			Str("traceId", spanContext.TraceID().String()).
+			Str("spanId", spanContext.SpanID().String())
+	}
+	return logCtx.Logger()
+}
+
+func logCall(logger zerolog.Logger, start time.Time, err error) {
+	code := status.Code(err)
+	var event *zerolog.Event
+	switch code {
+	case codes.OK, codes.Canceled, codes.InvalidArgument, codes.NotFound, codes.AlreadyExists,
+		codes.Unauthenticated, codes.PermissionDenied:
+		event = logger.Info()
+	default:
+		event = logger.Error().Err(err)
+	}
+	event.Str("code", code.String()).Dur("duration", time.Since(start)).Msg("Request handled")
+}
+
+func unaryAccessLogInterceptor(logger zerolog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		ctx, id := withIncomingRequestID(ctx)
+		grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadataKey, id))
+		log := requestLogger(ctx, logger, info.FullMethod)
+		log.Info().Msg("Request received")
+		resp, err := handler(log.WithContext(ctx), req)
+		logCall(log, start, err)
+		return resp, err
+	}
+}
+
+func streamAccessLogInterceptor(logger zerolog.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		ctx, id := withIncomingRequestID(ss.Context())
+		ss.SetHeader(metadata.Pairs(requestIDMetadataKey, id))
+		log := requestLogger(ctx, logger, info.FullMethod)
+		log.Info().Msg("Request received")
+		err := handler(srv, &wrappedServerStream{ServerStream: ss, ctx: log.WithContext(ctx)})
+		logCall(log, start, err)
+		return err
+	}
+}
+
+func recoverToError(ctx context.Context, fullMethod string, err *error) {
+	if r := recover(); r != nil {
+		zerolog.Ctx(ctx).Error().
+			Str("panic", fmt.Sprint(r)).
+			Str("stack", string(debug.Stack())).
+			Msgf("panic in %s", fullMethod)
+		*err = status.Error(codes.Internal, "internal error")
+	}
+}
+
+func unaryRecoveryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer recoverToError(ctx, info.FullMethod, &err)
+	return handler(ctx, req)
+}
+
+func streamRecoveryInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer recoverToError(ss.Context(), info.FullMethod, &err)
+	return handler(srv, ss)
+}
+
+func withMethodDeadline(ctx context.Context, timeouts map[string]time.Duration, fullMethod string) (context.Context, context.CancelFunc) {
+	_, method := splitMethodName(fullMethod)
+	timeout, ok := timeouts[method]
+	if !ok {
+		timeout = defaultMethodTimeout
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= timeout {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func unaryDeadlineInterceptor(timeouts map[string]time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, cancel := withMethodDeadline(ctx, timeouts, info.FullMethod)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+func streamDeadlineInterceptor(timeouts map[string]time.Duration) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, cancel := withMethodDeadline(ss.Context(), timeouts, info.FullMethod)
+		defer cancel()
+		return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func unaryValidationInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// validatingServerStream validates every message received by a stream.
+type validatingServerStream struct {
+	grpc.ServerStream
+}
+
+func (s *validatingServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return validateRequest(m)
+}
+
+func streamValidationInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &validatingServerStream{ServerStream: ss})
+}
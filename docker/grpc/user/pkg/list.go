@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+
+	pb "github.com/fcracker79/k8s-experiment/docker/grpc/user/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultListPageSize = 20
+	maxListPageSize     = 100
+)
+
+// AddCompanyColumn adds the company of the users to databases created before
+// users could belong to one.
+func AddCompanyColumn(db *sql.DB) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM pragma_table_info('users') WHERE name = 'company_id')").Scan(&exists)
+	if err != nil {
+		panic(err)
+	}
+	if !exists {
+		if _, err := db.Exec("ALTER TABLE users ADD COLUMN company_id TEXT"); err != nil {
+			panic(err)
+		}
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS users_company_id ON users(company_id, id)"); err != nil {
+		panic(err)
+	}
+}
+
+// ListUsers pages through the users ordered by id. Page tokens are the
+// encoded id of the last user returned, so pages stay consistent while
+// users are added or removed.
+func (s *server) ListUsers(ctx context.Context, in *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	pageSize := int(in.PageSize)
+	switch {
+	case pageSize <= 0:
+		pageSize = defaultListPageSize
+	case pageSize > maxListPageSize:
+		pageSize = maxListPageSize
+	}
+	after, err := base64.RawURLEncoding.DecodeString(in.PageToken)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page token %q", in.PageToken)
+	}
+
+	// One more user than needed tells whether there is a next page.
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT id, name, description, created_at, updated_at, company_id
+	FROM users
+	WHERE (? = '' OR company_id = ?) AND id > ?
+	ORDER BY id
+	LIMIT ?`,
+		in.CompanyId, in.CompanyId, string(after), pageSize+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	response := &pb.ListUsersResponse{}
+	for rows.Next() {
+		var id string
+		var name, description, createdAt, updatedAt, companyID sql.NullString
+		if err := rows.Scan(&id, &name, &description, &createdAt, &updatedAt, &companyID); err != nil {
+			return nil, err
+		}
+		response.Users = append(response.Users, &pb.User{
+			Id:          id,
+			Name:        name.String,
+			Description: description.String,
+			CreatedAt:   createdAt.String,
+			UpdatedAt:   updatedAt.String,
+			CompanyId:   companyID.String,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(response.Users) > pageSize {
+		response.Users = response.Users[:pageSize]
+		response.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(response.Users[pageSize-1].Id))
+	}
+	return response, nil
+}
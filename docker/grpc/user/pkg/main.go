@@ -3,30 +3,33 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
     "fmt"
 	"github.com/rs/zerolog/log"
 	"net"
     "os"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
 	"google.golang.org/grpc"
 	pb "github.com/fcracker79/k8s-experiment/docker/grpc/user/proto"
-	"github.com/rs/zerolog"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.25.0"
-	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 )
  
 type server struct {
 	pb.UnimplementedUserServiceServer
-	db *sql.DB
+	db     *sql.DB
+	events *eventPublisher
 }
 
 func initConn() (*grpc.ClientConn, error) {
@@ -74,48 +77,60 @@ func initTracerProvider(conn *grpc.ClientConn) (*sdktrace.TracerProvider, error)
 }
 
 func (s *server) CreateUser(ctx context.Context, in *pb.User) (*pb.User, error) {
-	stmt, err := s.db.Prepare("INSERT INTO users(id, name, description, created_at, updated_at) VALUES(?,?,?,?,?)")
+	stmt, err := s.db.PrepareContext(ctx, "INSERT INTO users(id, name, description, created_at, updated_at, company_id) VALUES(?,?,?,?,?,?)")
 	if err != nil {
 		return nil, err
 	}
-	_, err = stmt.Exec(in.Id, in.Name, in.Description, in.CreatedAt, in.UpdatedAt)
+	_, err = stmt.ExecContext(ctx, in.Id, in.Name, in.Description, in.CreatedAt, in.UpdatedAt, sql.NullString{String: in.CompanyId, Valid: in.CompanyId != ""})
 	if err != nil {
 		return nil, err
 	}
+	s.events.publish(ctx, userCreated, in.Id, in)
 	return in, nil
 }
 
 func (s *server) GetUser(ctx context.Context, in *pb.User) (*pb.User, error) {
-	row := s.db.QueryRow("SELECT name, description, created_at, updated_at FROM users WHERE id = ?", in.Id)
+	row := s.db.QueryRowContext(ctx, "SELECT name, description, created_at, updated_at, company_id FROM users WHERE id = ?", in.Id)
 	var name, description, createdAt, updatedAt string
-	err := row.Scan(&name, &description, &createdAt, &updatedAt)
+	var companyID sql.NullString
+	err := row.Scan(&name, &description, &createdAt, &updatedAt, &companyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.NotFound, "user %s not found", in.Id)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &pb.User{Id: in.Id, Name: name, Description: description, CreatedAt: createdAt, UpdatedAt: updatedAt}, nil
+	return &pb.User{Id: in.Id, Name: name, Description: description, CreatedAt: createdAt, UpdatedAt: updatedAt, CompanyId: companyID.String}, nil
 }
 
 func (s *server) UpdateUser(ctx context.Context, in *pb.User) (*pb.User, error) {
-	stmt, err := s.db.Prepare("UPDATE users SET name = ?, description = ?, updated_at = ? WHERE id = ?")
-	if err != nil {
-		return nil, err
+	// The stored user is returned, with its creation time and the update
+	// time set here rather than those of the request.
+	row := s.db.QueryRowContext(ctx, "UPDATE users SET name = ?, description = ?, updated_at = ?, company_id = ? WHERE id = ? RETURNING name, description, created_at, updated_at, company_id",
+		in.Name, in.Description, time.Now().Format(time.RFC3339), sql.NullString{String: in.CompanyId, Valid: in.CompanyId != ""}, in.Id)
+	var name, description, createdAt, updatedAt, companyID sql.NullString
+	err := row.Scan(&name, &description, &createdAt, &updatedAt, &companyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.NotFound, "user %s not found", in.Id)
 	}
-	_, err = stmt.Exec(in.Name, in.Description, time.Now().Format(time.RFC3339), in.Id)
 	if err != nil {
 		return nil, err
 	}
-	return in, nil
+	user := &pb.User{Id: in.Id, Name: name.String, Description: description.String, CreatedAt: createdAt.String, UpdatedAt: updatedAt.String, CompanyId: companyID.String}
+	s.events.publish(ctx, userUpdated, in.Id, user)
+	return user, nil
 }
 
 func (s *server) DeleteUser(ctx context.Context, in *pb.User) (*pb.User, error) {
-	stmt, err := s.db.Prepare("DELETE FROM users WHERE id = ?")
+	stmt, err := s.db.PrepareContext(ctx, "DELETE FROM users WHERE id = ?")
 	if err != nil {
 		return nil, err
 	}
-	_, err = stmt.Exec(in.Id)
+	_, err = stmt.ExecContext(ctx, in.Id)
 	if err != nil {
 		return nil, err
 	}
+	s.events.publish(ctx, userDeleted, in.Id, nil)
 	return in, nil
 }
 
@@ -127,22 +142,101 @@ func getEnvString(env string) string {
     }
 }
 
-func CreateTable(db *sql.DB) {
-    sql_table := `
+// The users are keyed by seq, an INTEGER PRIMARY KEY that users_fts refers
+// to: the implicit rowid of a table with a TEXT primary key may change on
+// VACUUM.
+const sql_table = `
     CREATE TABLE IF NOT EXISTS users(
-        id TEXT NOT NULL PRIMARY KEY,
+        seq INTEGER PRIMARY KEY,
+        id TEXT NOT NULL UNIQUE,
         name TEXT,
         description TEXT,
         created_at TIMESTAMP,
         updated_at TIMESTAMP);
     `
 
+func CreateTable(db *sql.DB) {
     _, err := db.Exec(sql_table)
     if err != nil {
         panic(err)
     }
 }
 
+// AddSequenceColumn rebuilds the users table of databases created before it
+// had seq, since SQLite cannot add a primary key to a table. The columns
+// added by the other migrations are copied as they are, and the search
+// index is dropped so that CreateSearchIndex builds it again on seq. It must
+// run right after CreateTable.
+func AddSequenceColumn(db *sql.DB) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM pragma_table_info('users') WHERE name = 'seq')").Scan(&exists)
+	if err != nil {
+		panic(err)
+	}
+	if exists {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	sql_rename := `
+	DROP TRIGGER IF EXISTS users_fts_insert;
+	DROP TRIGGER IF EXISTS users_fts_update;
+	DROP TRIGGER IF EXISTS users_fts_delete;
+	DROP TABLE IF EXISTS users_fts;
+	ALTER TABLE users RENAME TO users_without_seq;
+	`
+	if _, err := tx.Exec(sql_rename); err != nil {
+		panic(err)
+	}
+	if _, err := tx.Exec(sql_table); err != nil {
+		panic(err)
+	}
+	// Columns of the old table, and whether the new one lacks them.
+	rows, err := tx.Query(`
+	SELECT old.name, old.type, new.name IS NULL
+	FROM pragma_table_info('users_without_seq') old
+	LEFT JOIN pragma_table_info('users') new ON new.name = old.name`)
+	if err != nil {
+		panic(err)
+	}
+	var columns, added []string
+	for rows.Next() {
+		var name, columnType string
+		var missing bool
+		if err := rows.Scan(&name, &columnType, &missing); err != nil {
+			panic(err)
+		}
+		columns = append(columns, name)
+		if missing {
+			added = append(added, fmt.Sprintf("ALTER TABLE users ADD COLUMN %s %s", name, columnType))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+	rows.Close()
+	for _, statement := range added {
+		if _, err := tx.Exec(statement); err != nil {
+			panic(err)
+		}
+	}
+	list := strings.Join(columns, ", ")
+	sql_copy := fmt.Sprintf(`
+	INSERT INTO users(%s) SELECT %s FROM users_without_seq ORDER BY id;
+	DROP TABLE users_without_seq;
+	`, list, list)
+	if _, err := tx.Exec(sql_copy); err != nil {
+		panic(err)
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+}
+
 func main() {
 	otelCon, err := initConn()
 	if err != nil {
@@ -164,6 +258,9 @@ func main() {
 	}
 	defer db.Close()
     CreateTable(db)
+    AddSequenceColumn(db)
+    AddCompanyColumn(db)
+    CreateSearchIndex(db)
 
     tcpPort := getEnvString("TCP_PORT")
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", tcpPort))
@@ -171,38 +268,43 @@ func main() {
 		log.Fatal().Msgf("failed to listen: %v", err)
 	}
 	
-	s := grpc.NewServer(
+	unaryInterceptors, streamInterceptors, err := newServerInterceptors()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not create interceptors")
+	}
+	startMetricsServer()
+
+	options := []grpc.ServerOption{
 		grpc.StatsHandler(
 			otelgrpc.NewServerHandler(
 				otelgrpc.WithTracerProvider(tracerProvider),
 			),
 		),
-		grpc.UnaryInterceptor(serverLoggingInterceptor))
-	pb.RegisterUserServiceServer(s, &server{db: db})
-
-	log.Printf("Server listening on port %s", tcpPort)
-	if err := s.Serve(lis); err != nil {
-		log.Fatal().Msgf("failed to serve: %v", err)
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
 	}
-}
-
-func serverLoggingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	span := trace.SpanFromContext(ctx)
-		
-	traceID, err := span.SpanContext().TraceID().MarshalJSON()
+	transportCredentials, err := newServerTransportCredentials()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not load TLS credentials")
+	}
+	if transportCredentials != nil {
+		options = append(options, grpc.Creds(transportCredentials))
+	}
+	events, err := newEventPublisher()
 	if err != nil {
-		log.Fatal().Err(err).Msg("could not marshal traceID")
+		log.Fatal().Err(err).Msg("could not create event publisher")
 	}
+	s := grpc.NewServer(options...)
+	pb.RegisterUserServiceServer(s, &server{db: db, events: events})
 
-	spanID, err := span.SpanContext().SpanID().MarshalJSON()
+	stopAdminServer, err := startAdminServer(s)
 	if err != nil {
-		log.Fatal().Err(err).Msg("could not marshal spanID")
+		log.Fatal().Err(err).Msg("could not start admin server")
 	}
+	defer stopAdminServer()
 
-	log := zerolog.New(os.Stderr).With().Timestamp().
-		Str("traceId", string(traceID)).
-		Str("spanId", string(spanID)).
-		Logger()
-	log.Info().Msg("Request received")
-	return handler(log.WithContext(ctx), req)
+	log.Printf("Server listening on port %s", tcpPort)
+	if err := s.Serve(lis); err != nil {
+		log.Fatal().Msgf("failed to serve: %v", err)
+	}
 }
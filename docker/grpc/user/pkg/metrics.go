@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Port of the HTTP server exposing /metrics. When not set metrics are
+// collected but not served.
+const metricsTCPPort = "METRICS_TCP_PORT"
+
+var (
+	grpcServerStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_started_total",
+		Help: "Total number of RPCs started on the server.",
+	}, []string{"grpc_type", "grpc_service", "grpc_method"})
+
+	grpcServerHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_handled_total",
+		Help: "Total number of RPCs completed on the server, regardless of success or failure.",
+	}, []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"})
+
+	grpcServerHandlingSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_handling_seconds",
+		Help:    "Histogram of response latency (seconds) of RPCs handled by the server.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"grpc_type", "grpc_service", "grpc_method"})
+
+	grpcServerMsgReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_msg_received_total",
+		Help: "Total number of stream messages received from the client.",
+	}, []string{"grpc_type", "grpc_service", "grpc_method"})
+
+	grpcServerMsgSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_msg_sent_total",
+		Help: "Total number of stream messages sent by the server.",
+	}, []string{"grpc_type", "grpc_service", "grpc_method"})
+
+	faultsInjected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_faults_injected_total",
+		Help: "Total number of faults injected in the RPCs by method and action: delay, code or drop.",
+	}, []string{"grpc_method", "action"})
+)
+
+func streamType(info *grpc.StreamServerInfo) string {
+	switch {
+	case info.IsClientStream && info.IsServerStream:
+		return "bidi_stream"
+	case info.IsClientStream:
+		return "client_stream"
+	default:
+		return "server_stream"
+	}
+}
+
+func observeCall(grpcType, fullMethod string, start time.Time, err error) {
+	service, method := splitMethodName(fullMethod)
+	grpcServerHandled.WithLabelValues(grpcType, service, method, status.Code(err).String()).Inc()
+	grpcServerHandlingSeconds.WithLabelValues(grpcType, service, method).Observe(time.Since(start).Seconds())
+}
+
+func unaryMetricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	service, method := splitMethodName(info.FullMethod)
+	grpcServerStarted.WithLabelValues("unary", service, method).Inc()
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeCall("unary", info.FullMethod, start, err)
+	return resp, err
+}
+
+// monitoredServerStream counts the messages going through a stream.
+type monitoredServerStream struct {
+	grpc.ServerStream
+	received prometheus.Counter
+	sent     prometheus.Counter
+}
+
+func (s *monitoredServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent.Inc()
+	}
+	return err
+}
+
+func (s *monitoredServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.received.Inc()
+	}
+	return err
+}
+
+func streamMetricsInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	grpcType := streamType(info)
+	service, method := splitMethodName(info.FullMethod)
+	grpcServerStarted.WithLabelValues(grpcType, service, method).Inc()
+	start := time.Now()
+	err := handler(srv, &monitoredServerStream{
+		ServerStream: ss,
+		received:     grpcServerMsgReceived.WithLabelValues(grpcType, service, method),
+		sent:         grpcServerMsgSent.WithLabelValues(grpcType, service, method),
+	})
+	observeCall(grpcType, info.FullMethod, start, err)
+	return err
+}
+
+// startMetricsServer serves the Prometheus metrics on METRICS_TCP_PORT.
+func startMetricsServer() {
+	port, exists := os.LookupEnv(metricsTCPPort)
+	if !exists {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Printf("Metrics server listening on port %s", port)
+		if err := http.ListenAndServe(fmt.Sprintf(":%s", port), mux); err != nil {
+			log.Error().Err(err).Msg("metrics server stopped")
+		}
+	}()
+}
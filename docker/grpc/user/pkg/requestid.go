@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// The gateway sends the id of the request behind a call with this
+	// metadata key. Calls without a valid one get a new id. It is returned
+	// with the response headers, logged as requestId and forwarded to the
+	// consumers of the events with the header.
+	requestIDMetadataKey = "x-request-id"
+	requestIDHeader      = "X-Request-ID"
+
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID accepts the ids that are safe to log and to forward: up to
+// maxRequestIDLength letters, digits and "-_.:".
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withIncomingRequestID stores the request id of the call in ctx.
+func withIncomingRequestID(ctx context.Context) (context.Context, string) {
+	var id string
+	if values := metadata.ValueFromIncomingContext(ctx, requestIDMetadataKey); len(values) > 0 && validRequestID(values[0]) {
+		id = values[0]
+	} else {
+		var raw [16]byte
+		rand.Read(raw[:])
+		id = hex.EncodeToString(raw[:])
+	}
+	return context.WithValue(ctx, requestIDKey{}, id), id
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"unicode"
+
+	pb "github.com/fcracker79/k8s-experiment/docker/grpc/user/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+
+	// Relative weight of name and description matches in the BM25 ranking.
+	searchNameWeight        = 2.0
+	searchDescriptionWeight = 1.0
+)
+
+// CreateSearchIndex creates users_fts, an external content FTS5 index over
+// the name and description of users, and the triggers that keep it in sync.
+// The index is built from the existing users the first time it is created.
+func CreateSearchIndex(db *sql.DB) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'users_fts')").Scan(&exists)
+	if err != nil {
+		panic(err)
+	}
+
+	sql_index := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS users_fts USING fts5(
+		name,
+		description,
+		content = 'users',
+		content_rowid = 'seq',
+		prefix = '2 3');
+
+	CREATE TRIGGER IF NOT EXISTS users_fts_insert AFTER INSERT ON users BEGIN
+		INSERT INTO users_fts(rowid, name, description) VALUES (new.seq, new.name, new.description);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS users_fts_update AFTER UPDATE ON users BEGIN
+		INSERT INTO users_fts(users_fts, rowid, name, description) VALUES ('delete', old.seq, old.name, old.description);
+		INSERT INTO users_fts(rowid, name, description) VALUES (new.seq, new.name, new.description);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS users_fts_delete AFTER DELETE ON users BEGIN
+		INSERT INTO users_fts(users_fts, rowid, name, description) VALUES ('delete', old.seq, old.name, old.description);
+	END;
+	`
+	if _, err := db.Exec(sql_index); err != nil {
+		panic(err)
+	}
+	if !exists {
+		if _, err := db.Exec("INSERT INTO users_fts(users_fts) VALUES ('rebuild')"); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// toMatchQuery turns free text into an FTS5 query matching every word as a
+// prefix. Words are quoted so FTS5 operators in the input are not
+// interpreted.
+func toMatchQuery(query string) string {
+	words := strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	terms := make([]string, len(words))
+	for i, word := range words {
+		terms[i] = `"` + word + `"*`
+	}
+	return strings.Join(terms, " AND ")
+}
+
+func (s *server) SearchUsers(ctx context.Context, in *pb.SearchUsersRequest) (*pb.SearchUsersResponse, error) {
+	match := toMatchQuery(in.Query)
+	if match == "" {
+		return nil, status.Error(codes.InvalidArgument, "query must contain at least one word")
+	}
+	pageSize := int(in.PageSize)
+	switch {
+	case pageSize <= 0:
+		pageSize = defaultSearchPageSize
+	case pageSize > maxSearchPageSize:
+		pageSize = maxSearchPageSize
+	}
+	offset := 0
+	if in.PageToken != "" {
+		var err error
+		offset, err = strconv.Atoi(in.PageToken)
+		if err != nil || offset < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token %q", in.PageToken)
+		}
+	}
+
+	var total int64
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users_fts WHERE users_fts MATCH ?", match).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT u.id, u.name, u.description, u.created_at, u.updated_at, u.company_id,
+		bm25(users_fts, ?, ?) AS rank,
+		highlight(users_fts, 0, '<mark>', '</mark>'),
+		snippet(users_fts, 1, '<mark>', '</mark>', '…', 16)
+	FROM users_fts JOIN users u ON u.seq = users_fts.rowid
+	WHERE users_fts MATCH ?
+	ORDER BY rank, u.id
+	LIMIT ? OFFSET ?`,
+		searchNameWeight, searchDescriptionWeight, match, pageSize, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	response := &pb.SearchUsersResponse{TotalSize: total}
+	for rows.Next() {
+		var id string
+		var name, description, createdAt, updatedAt, companyID, nameHighlight, snippet sql.NullString
+		var rank float64
+		if err := rows.Scan(&id, &name, &description, &createdAt, &updatedAt, &companyID, &rank, &nameHighlight, &snippet); err != nil {
+			return nil, err
+		}
+		response.Results = append(response.Results, &pb.SearchUsersResult{
+			User: &pb.User{
+				Id:          id,
+				Name:        name.String,
+				Description: description.String,
+				CreatedAt:   createdAt.String,
+				UpdatedAt:   updatedAt.String,
+				CompanyId:   companyID.String,
+			},
+			Rank:               rank,
+			NameHighlight:      nameHighlight.String,
+			DescriptionSnippet: snippet.String,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if next := offset + len(response.Results); int64(next) < total {
+		response.NextPageToken = strconv.Itoa(next)
+	}
+	return response, nil
+}
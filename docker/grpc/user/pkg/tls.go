@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// Certificate and key of the server and the CA bundle client
+	// certificates are verified against, all PEM. When GRPC_TLS_CERT_FILE is
+	// not set the server listens in plaintext.
+	grpcTLSCertFile = "GRPC_TLS_CERT_FILE"
+	grpcTLSKeyFile  = "GRPC_TLS_KEY_FILE"
+	grpcTLSCAFile   = "GRPC_TLS_CA_FILE"
+	// Comma separated SPIFFE IDs clients must present, a trailing * matches
+	// any suffix. When not set any client certificate signed by the CA is
+	// accepted.
+	grpcTLSAllowedSPIFFEIDs = "GRPC_TLS_ALLOWED_SPIFFE_IDS"
+
+	// Certificate files are checked for changes at most this often.
+	certReloadCheckInterval = 10 * time.Second
+)
+
+// certReloader keeps a key pair and a CA bundle loaded from files, reloading
+// them when the files change so that rotated certificates are picked up
+// without a restart.
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	roots     *x509.CertPool
+	modTimes  [3]time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	modTimes, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) stat() ([3]time.Time, error) {
+	var modTimes [3]time.Time
+	for i, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (r *certReloader) load(modTimes [3]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load key pair: %w", err)
+	}
+	pem, err := os.ReadFile(r.caFile)
+	if err != nil {
+		return fmt.Errorf("could not read CA bundle: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", r.caFile)
+	}
+	r.cert, r.roots, r.modTimes = &cert, roots, modTimes
+	return nil
+}
+
+// current returns the key pair and the CA bundle, reloading them first if
+// the files changed. Reload failures keep the previous ones.
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastCheck) < certReloadCheckInterval {
+		return r.cert, r.roots
+	}
+	r.lastCheck = time.Now()
+	modTimes, err := r.stat()
+	if err != nil {
+		log.Error().Err(err).Msg("could not check certificates, keeping the current ones")
+	} else if modTimes != r.modTimes {
+		if err := r.load(modTimes); err != nil {
+			log.Error().Err(err).Msg("could not reload certificates, keeping the current ones")
+		} else {
+			log.Info().Msg("Certificates reloaded")
+		}
+	}
+	return r.cert, r.roots
+}
+
+// spiffeID returns the SPIFFE ID in the URI SANs of cert.
+func spiffeID(cert *x509.Certificate) (string, error) {
+	var id string
+	for _, uri := range cert.URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		if id != "" {
+			return "", errors.New("certificate has more than one SPIFFE ID")
+		}
+		id = uri.String()
+	}
+	if id == "" {
+		return "", errors.New("certificate has no SPIFFE ID")
+	}
+	return id, nil
+}
+
+func parseSPIFFEIDs(value string) []string {
+	var ids []string
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func matchSPIFFEID(id string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, pattern := range allowed {
+		if prefix, wildcard := strings.CutSuffix(pattern, "*"); wildcard && strings.HasPrefix(id, prefix) {
+			return true
+		}
+		if id == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPeer checks the peer certificate chain against roots and the SPIFFE
+// ID of the leaf against allowed.
+func verifyPeer(chain []*x509.Certificate, roots *x509.CertPool, usage x509.ExtKeyUsage, allowed []string) error {
+	if len(chain) == 0 {
+		return errors.New("no peer certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return err
+	}
+	id, err := spiffeID(chain[0])
+	if err != nil {
+		return err
+	}
+	if !matchSPIFFEID(id, allowed) {
+		return fmt.Errorf("SPIFFE ID %s is not allowed", id)
+	}
+	return nil
+}
+
+// newServerTransportCredentials returns mTLS credentials for the user service,
+// nil when TLS is not configured.
+func newServerTransportCredentials() (credentials.TransportCredentials, error) {
+	certFile, exists := os.LookupEnv(grpcTLSCertFile)
+	if !exists {
+		return nil, nil
+	}
+	keyFile, err := getEnvStringOrError(grpcTLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	caFile, err := getEnvStringOrError(grpcTLSCAFile)
+	if err != nil {
+		return nil, err
+	}
+	reloader, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	allowed := parseSPIFFEIDs(os.Getenv(grpcTLSAllowedSPIFFEIDs))
+
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The chain is verified by VerifyConnection against the current CA
+		// bundle, which tls.Config cannot reload by itself.
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := reloader.current()
+			return cert, nil
+		},
+		VerifyConnection: func(state tls.ConnectionState) error {
+			_, roots := reloader.current()
+			return verifyPeer(state.PeerCertificates, roots, x509.ExtKeyUsageClientAuth, allowed)
+		},
+	}), nil
+}
+
+func getEnvStringOrError(env string) (string, error) {
+	if envVar, exists := os.LookupEnv(env); exists {
+		return envVar, nil
+	} else {
+		return "", fmt.Errorf("%s not set", env)
+	}
+}
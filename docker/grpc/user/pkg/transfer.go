@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"time"
+
+	pb "github.com/fcracker79/k8s-experiment/docker/grpc/user/proto"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Number of users written in a single transaction by ImportUsers. A progress
+// acknowledgement is sent after every batch is committed.
+const importBatchSize = 100
+
+// ImportUsers reads users from the client stream and writes them in batches.
+// Every acknowledged batch is committed, so a failed import can be resumed
+// by sending only the users that were not acknowledged yet. The import is
+// not atomic: when it fails, or the client cancels it, the committed batches
+// stay and only the batch being filled is dropped.
+func (s *server) ImportUsers(stream pb.UserService_ImportUsersServer) error {
+	ctx := stream.Context()
+	logger := zerolog.Ctx(ctx)
+
+	var (
+		progress pb.ImportUsersProgress
+		policy   pb.ConflictPolicy
+		batch    []*pb.User
+	)
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if progress.Received == 0 {
+			policy = req.ConflictPolicy
+		}
+		if req.User == nil || req.User.Id == "" {
+			return status.Errorf(codes.InvalidArgument, "user #%d has no id", progress.Received+1)
+		}
+		progress.Received++
+		batch = append(batch, req.User)
+		if len(batch) < importBatchSize {
+			continue
+		}
+		if err := s.importBatch(ctx, batch, policy, &progress); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		if err := stream.Send(&progress); err != nil {
+			return err
+		}
+	}
+	if err := s.importBatch(ctx, batch, policy, &progress); err != nil {
+		return err
+	}
+	progress.Done = true
+	logger.Info().Msgf("Imported users: %d received, %d created, %d updated, %d skipped",
+		progress.Received, progress.Created, progress.Updated, progress.Skipped)
+	return stream.Send(&progress)
+}
+
+func (s *server) importBatch(ctx context.Context, users []*pb.User, policy pb.ConflictPolicy, progress *pb.ImportUsersProgress) error {
+	if len(users) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	created, updated, skipped := progress.Created, progress.Updated, progress.Skipped
+	now := time.Now().Format(time.RFC3339)
+	// Change events of each user, published once the batch is committed.
+	events := make([]string, len(users))
+	for i, user := range users {
+		var exists bool
+		err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", user.Id).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		createdAt, updatedAt := user.CreatedAt, user.UpdatedAt
+		if createdAt == "" {
+			createdAt = now
+		}
+		if updatedAt == "" {
+			updatedAt = now
+		}
+		companyID := sql.NullString{String: user.CompanyId, Valid: user.CompanyId != ""}
+		switch {
+		case !exists:
+			_, err = tx.ExecContext(ctx, "INSERT INTO users(id, name, description, created_at, updated_at, company_id) VALUES(?,?,?,?,?,?)",
+				user.Id, user.Name, user.Description, createdAt, updatedAt, companyID)
+			created++
+			events[i] = userCreated
+		case policy == pb.ConflictPolicy_CONFLICT_POLICY_SKIP:
+			skipped++
+		case policy == pb.ConflictPolicy_CONFLICT_POLICY_FAIL:
+			return status.Errorf(codes.AlreadyExists, "user %s already exists", user.Id)
+		default:
+			_, err = tx.ExecContext(ctx, "UPDATE users SET name = ?, description = ?, created_at = ?, updated_at = ?, company_id = ? WHERE id = ?",
+				user.Name, user.Description, createdAt, updatedAt, companyID, user.Id)
+			updated++
+			events[i] = userUpdated
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for i, eventType := range events {
+		if eventType != "" {
+			s.events.publish(ctx, eventType, users[i].Id, users[i])
+		}
+	}
+	progress.Created, progress.Updated, progress.Skipped = created, updated, skipped
+	return nil
+}
+
+// ExportUsers streams every user ordered by id.
+func (s *server) ExportUsers(in *pb.ExportUsersRequest, stream pb.UserService_ExportUsersServer) error {
+	ctx := stream.Context()
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, description, created_at, updated_at, company_id FROM users ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var name, description, createdAt, updatedAt, companyID sql.NullString
+		if err := rows.Scan(&id, &name, &description, &createdAt, &updatedAt, &companyID); err != nil {
+			return err
+		}
+		user := &pb.User{
+			Id:          id,
+			Name:        name.String,
+			Description: description.String,
+			CreatedAt:   createdAt.String,
+			UpdatedAt:   updatedAt.String,
+			CompanyId:   companyID.String,
+		}
+		if err := stream.Send(user); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
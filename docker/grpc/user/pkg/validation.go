@@ -0,0 +1,64 @@
+package main
+
+import (
+	"unicode/utf8"
+
+	pb "github.com/fcracker79/k8s-experiment/docker/grpc/user/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	maxUserIDLength          = 128
+	maxUserNameLength        = 256
+	maxUserDescriptionLength = 4096
+	maxSearchQueryLength     = 256
+)
+
+// validateRequest checks the messages received by UserService, returning an
+// InvalidArgument status describing the first problem found.
+func validateRequest(req interface{}) error {
+	switch req := req.(type) {
+	case *pb.User:
+		return validateUser(req)
+	case *pb.ImportUsersRequest:
+		if _, ok := pb.ConflictPolicy_name[int32(req.ConflictPolicy)]; !ok {
+			return status.Errorf(codes.InvalidArgument, "unknown conflict policy %d", req.ConflictPolicy)
+		}
+		if req.User == nil {
+			return status.Error(codes.InvalidArgument, "user is required")
+		}
+		return validateUser(req.User)
+	case *pb.SearchUsersRequest:
+		if req.Query == "" {
+			return status.Error(codes.InvalidArgument, "query is required")
+		}
+		if utf8.RuneCountInString(req.Query) > maxSearchQueryLength {
+			return status.Errorf(codes.InvalidArgument, "query is longer than %d characters", maxSearchQueryLength)
+		}
+		if req.PageSize < 0 {
+			return status.Error(codes.InvalidArgument, "page_size must not be negative")
+		}
+	case *pb.ListUsersRequest:
+		if req.PageSize < 0 {
+			return status.Error(codes.InvalidArgument, "page_size must not be negative")
+		}
+	}
+	return nil
+}
+
+func validateUser(user *pb.User) error {
+	switch {
+	case user.Id == "":
+		return status.Error(codes.InvalidArgument, "id is required")
+	case utf8.RuneCountInString(user.Id) > maxUserIDLength:
+		return status.Errorf(codes.InvalidArgument, "id is longer than %d characters", maxUserIDLength)
+	case utf8.RuneCountInString(user.Name) > maxUserNameLength:
+		return status.Errorf(codes.InvalidArgument, "name is longer than %d characters", maxUserNameLength)
+	case utf8.RuneCountInString(user.Description) > maxUserDescriptionLength:
+		return status.Errorf(codes.InvalidArgument, "description is longer than %d characters", maxUserDescriptionLength)
+	case utf8.RuneCountInString(user.CompanyId) > maxUserIDLength:
+		return status.Errorf(codes.InvalidArgument, "company_id is longer than %d characters", maxUserIDLength)
+	}
+	return nil
+}
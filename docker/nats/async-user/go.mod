@@ -2,7 +2,10 @@ module github.com/fcracker79/k8s-experiment/docker/nats/async_users
 
 go 1.22.3
 
-require github.com/rs/zerolog v1.33.0
+require (
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/rs/zerolog v1.33.0
+)
 
 require (
 	github.com/cenkalti/backoff/v4 v4.3.0 // indirect
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+// Port of the HTTP server managing the injected faults on /faults. When not
+// set no fault can be injected.
+const faultsAdminTCPPort = "FAULTS_ADMIN_TCP_PORT"
+
+// duration is a time.Duration read from JSON strings such as "250ms".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// faultMatch selects the messages a fault applies to. Empty fields match
+// any message.
+type faultMatch struct {
+	Subject string `json:"subject,omitempty"`
+	// Header values the message must have, * for any value.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// faultRule injects a fault in a share of the messages it matches.
+type faultRule struct {
+	Match faultMatch `json:"match"`
+	// Percentage of the matched messages affected, all of them when not
+	// set. 0 pauses the rule.
+	Percent *float64 `json:"percent,omitempty"`
+	// Latency added before the message is processed or failed.
+	Delay duration `json:"delay,omitempty"`
+	// Fail the processing: the message is redelivered.
+	Nak bool `json:"nak,omitempty"`
+	// Acknowledge the message without processing it, as if it was lost.
+	Drop bool `json:"drop,omitempty"`
+}
+
+type faultRules struct {
+	Rules []*faultRule `json:"rules"`
+}
+
+func (f *faultRule) validate() error {
+	if f.Percent != nil && (*f.Percent < 0 || *f.Percent > 100) {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	if f.Delay < 0 {
+		return fmt.Errorf("delay must not be negative")
+	}
+	if f.Nak && f.Drop {
+		return fmt.Errorf("a fault either fails or drops the message")
+	}
+	if f.Delay == 0 && !f.Nak && !f.Drop {
+		return fmt.Errorf("no fault to inject")
+	}
+	return nil
+}
+
+// hit tells whether the rule applies to one of the messages it matches.
+func (f *faultRule) hit() bool {
+	return f.Percent == nil || rand.Float64()*100 < *f.Percent
+}
+
+func (f *faultRule) matches(msg *nats.Msg) bool {
+	if f.Match.Subject != "" && f.Match.Subject != msg.Subject {
+		return false
+	}
+	for name, value := range f.Match.Headers {
+		if actual := msg.Header.Get(name); actual == "" || (value != "*" && value != actual) {
+			return false
+		}
+	}
+	return true
+}
+
+// faultInjector adds latency, failures and lost messages to the messages
+// consumed, for chaos experiments. Its rules are replaced at runtime through
+// the admin server.
+type faultInjector struct {
+	rules  atomic.Pointer[faultRules]
+	logger zerolog.Logger
+}
+
+// newFaultInjector starts the admin server of the faults on
+// FAULTS_ADMIN_TCP_PORT, returning nil when it is not set.
+func newFaultInjector(logger zerolog.Logger) *faultInjector {
+	port, exists := os.LookupEnv(faultsAdminTCPPort)
+	if !exists {
+		return nil
+	}
+	f := &faultInjector{logger: logger}
+	f.rules.Store(&faultRules{Rules: []*faultRule{}})
+	mux := http.NewServeMux()
+	mux.Handle("/faults", f)
+	go func() {
+		logger.Info().Msgf("Faults admin server listening on port %s", port)
+		if err := http.ListenAndServe(fmt.Sprintf(":%s", port), mux); err != nil {
+			logger.Error().Err(err).Msg("faults admin server stopped")
+		}
+	}()
+	return f
+}
+
+// ServeHTTP lists the rules on GET, replaces them with the ones of the body
+// on PUT and removes them on DELETE.
+func (f *faultInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var rules faultRules
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i, rule := range rules.Rules {
+			if err := rule.validate(); err != nil {
+				http.Error(w, fmt.Sprintf("rule %d: %v", i, err), http.StatusBadRequest)
+				return
+			}
+		}
+		f.rules.Store(&rules)
+		f.logger.Warn().Int("rules", len(rules.Rules)).Msg("fault rules replaced")
+	case http.MethodDelete:
+		f.rules.Store(&faultRules{Rules: []*faultRule{}})
+		f.logger.Warn().Msg("fault rules removed")
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.rules.Load())
+}
+
+// inject applies the first rule matching a message, unless its percentage
+// misses. It returns true when the message must not be processed, having
+// been failed or dropped.
+func (f *faultInjector) inject(ctx context.Context, msg *nats.Msg) bool {
+	if f == nil {
+		return false
+	}
+	var rule *faultRule
+	for _, r := range f.rules.Load().Rules {
+		if r.matches(msg) {
+			rule = r
+			break
+		}
+	}
+	if rule == nil || !rule.hit() {
+		return false
+	}
+	logger := zerolog.Ctx(ctx).With().Str("requestId", msg.Header.Get(requestIDHeader)).Logger()
+	if rule.Delay > 0 {
+		logger.Warn().Dur("delay", time.Duration(rule.Delay)).Msg("fault injected: delaying the message")
+		time.Sleep(time.Duration(rule.Delay))
+	}
+	switch {
+	case rule.Nak:
+		logger.Warn().Msg("fault injected: failing the message")
+		if err := msg.Nak(); err != nil {
+			logger.Error().Err(err).Msg("could not nak the message")
+		}
+		return true
+	case rule.Drop:
+		logger.Warn().Msg("fault injected: dropping the message")
+		if err := msg.Ack(); err != nil {
+			logger.Error().Err(err).Msg("could not ack the message")
+		}
+		return true
+	}
+	return false
+}
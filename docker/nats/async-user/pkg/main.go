@@ -18,6 +18,7 @@ import (
 	"go.opentelemetry.io/otel/propagation"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"go.opentelemetry.io/otel/trace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/sdk/resource"
@@ -30,6 +31,12 @@ const (
 	natsCreateUserSubject = "NATS_CREATE_USER_SUBJECT"
 	grpcUserHost          = "GRPC_USER_HOST"
 
+	// The gateway sends the id of the request behind a message with this
+	// header, it is logged as requestId and forwarded to the user service
+	// with the metadata key.
+	requestIDHeader      = "X-Request-ID"
+	requestIDMetadataKey = "x-request-id"
+
 	natsDurableConsumerName = "asyncUserCreator"
 )
 
@@ -69,6 +76,13 @@ func main() {
 	}
 	defer nc.Close()
 
+	if _, err := getUserTransportCredentials(); err != nil {
+		logger.Fatal().Err(err).Msg("could not initialize the user service TLS")
+	}
+	if _, err := getServiceIdentity(); err != nil {
+		logger.Fatal().Err(err).Msg("could not initialize the service identity")
+	}
+
 	subject := getEnvString(natsCreateUserSubject)
 	// Subscribe to subject
 	js, err := nc.JetStream(nats.PublishAsyncMaxPending(256))
@@ -76,8 +90,14 @@ func main() {
 		logger.Fatal().Err(err).Msg("failed to connect to Jetstream")
 	}
 
+	faults := newFaultInjector(logger)
 	sub, err := js.Subscribe(subject, 
-		func(msg *nats.Msg){createUserFromMessage(ctx, msg)},
+		func(msg *nats.Msg){
+			if faults.inject(ctx, msg) {
+				return
+			}
+			createUserFromMessage(ctx, msg)
+		},
 		nats.Durable(natsDurableConsumerName))
 	if err != nil {
 		logger.Fatal().Err(err).Msgf("failed to subscribe to NATS stream %s", subject)
@@ -108,7 +128,11 @@ func createUserFromMessage(ctx context.Context, msg *nats.Msg) {
 		logger.Fatal().Err(err).Msg("could not marshal traceID")
 	}
 	
-	loggerWithTrace := zerolog.Ctx(ctx).With().Str("traceId", string(traceID)).Str("spanId", string(spanID)).Logger()
+	requestID := msg.Header.Get(requestIDHeader)
+	if requestID != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, requestID)
+	}
+	loggerWithTrace := zerolog.Ctx(ctx).With().Str("requestId", requestID).Str("traceId", string(traceID)).Str("spanId", string(spanID)).Logger()
 	logger = &loggerWithTrace
 	
 	logger.Info().Msgf("Received a message: %s\n", string(msg.Data))
@@ -119,7 +143,12 @@ func createUserFromMessage(ctx context.Context, msg *nats.Msg) {
 	}
 	connection, err := createGrpcConnection()
 	if err != nil {
-		logger.Fatal().Err(err).Msg("did not connect")
+		// Redelivered later, the user service may be reachable by then.
+		logger.Error().Err(err).Msg("did not connect")
+		if err := msg.Nak(); err != nil {
+			logger.Error().Err(err).Msg("could not nak the message")
+		}
+		return
 	}
 	defer connection.Close()
 	c := pb.NewUserServiceClient(connection)
@@ -131,13 +160,23 @@ func createUserFromMessage(ctx context.Context, msg *nats.Msg) {
 }
 
 func createGrpcConnection() (*grpc.ClientConn, error) {
-	connection, err := grpc.NewClient(
-		getUserGrpcEndpoint(),
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	transportCredentials, err := getUserTransportCredentials()
+	if err != nil {
+		return nil, err
+	}
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(transportCredentials),
 		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
 		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()),
-	)
-	return connection, err
+	}
+	identity, err := getServiceIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if identity != nil {
+		options = append(options, grpc.WithPerRPCCredentials(identity))
+	}
+	return grpc.NewClient(getUserGrpcEndpoint(), options...)
 }
 
 func getUserGrpcEndpoint() string {
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// NATS server the change events are published to. When not set no event
+	// is published.
+	natsUrl = "NATS_URL"
+	// Subjects of the events are this prefix followed by the event type, e.g.
+	// k8s.experiment.companies.events.deleted.
+	natsCompanyEventsSubject = "NATS_COMPANY_EVENTS_SUBJECT"
+)
+
+const (
+	companyCreated = "created"
+	companyUpdated = "updated"
+	companyDeleted = "deleted"
+)
+
+// companyEvent is the JSON payload of a change event. Company is not set
+// for deletions.
+type companyEvent struct {
+	Type    string    `json:"type"`
+	ID      string    `json:"id"`
+	Company *Company  `json:"company,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// eventPublisher publishes company change events, so that caches and other
+// services can react to them.
+type eventPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+var events *eventPublisher
+
+// newEventPublisher connects to NATS_URL. It returns nil when events are
+// disabled.
+func newEventPublisher() (*eventPublisher, error) {
+	url, exists := os.LookupEnv(natsUrl)
+	if !exists {
+		return nil, nil
+	}
+	subject, exists := os.LookupEnv(natsCompanyEventsSubject)
+	if !exists {
+		return nil, fmt.Errorf("%s not set", natsCompanyEventsSubject)
+	}
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to NATS: %w", err)
+	}
+	return &eventPublisher{conn: conn, subject: subject}, nil
+}
+
+// publish sends an event without waiting for NATS, failures are only
+// logged: the change is already committed.
+func (p *eventPublisher) publish(ctx context.Context, eventType, id string, company *Company) {
+	if p == nil {
+		return
+	}
+	data, err := json.Marshal(companyEvent{Type: eventType, ID: id, Company: company, Time: time.Now().UTC()})
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("could not marshal company event")
+		return
+	}
+	header := make(nats.Header)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+	if id := requestIDFromContext(ctx); id != "" {
+		header.Set(requestIDHeader, id)
+	}
+	msg := &nats.Msg{
+		Subject: p.subject + "." + eventType,
+		Data:    data,
+		Header:  header,
+	}
+	if err := p.conn.PublishMsg(msg); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("could not publish %s event for company %s", eventType, id)
+	}
+}
@@ -104,18 +104,26 @@ func main() {
 			log.Fatal().Err(err).Msg("Failed to shutdown TracerProvider")
 		}
 	}()
+	events, err = newEventPublisher()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not create event publisher")
+	}
+
+	faults := newFaultInjector()
 
     r := chi.NewRouter()
 	r.Use(otelchi.Middleware("company", otelchi.WithChiRoutes(r)))
+	r.Use(RequestIDMiddleware)
 	r.Use(LogMiddleware)
     r.Route("/companies", func(r chi.Router) {
-        r.Get("/", listCompanies)    // GET List Companies
-        r.Post("/", createCompany)   // POST Create a new Company
+        // Inline, so that faults are matched by route pattern
+        r.With(faults.Middleware).Get("/", listCompanies)    // GET List Companies
+        r.With(faults.Middleware).Post("/", createCompany)   // POST Create a new Company
 
         r.Route("/{id}", func(r chi.Router) {
-            r.Get("/", getCompany)    // GET a specific Company
-            r.Put("/", updateCompany) // PUT Update a specific Company
-            r.Delete("/", deleteCompany) // DELETE a specific Company
+            r.With(faults.Middleware).Get("/", getCompany)    // GET a specific Company
+            r.With(faults.Middleware).Put("/", updateCompany) // PUT Update a specific Company
+            r.With(faults.Middleware).Delete("/", deleteCompany) // DELETE a specific Company
         })
     })
 
@@ -149,6 +157,7 @@ func LogMiddleware(next http.Handler) http.Handler {
 		}
 
 		log := zerolog.New(os.Stderr).With().Timestamp().
+			Str("requestId", requestIDFromContext(r.Context())).
 			Str("traceId", string(traceID)).
 			Str("spanId", string(spanID)).
 			Logger()
@@ -205,6 +214,7 @@ func createCompany(w http.ResponseWriter, r *http.Request) {
         http.Error(w, err.Error(), 500)
         return
     }
+    events.publish(r.Context(), companyCreated, company.ID, &company)
 
     json.NewEncoder(w).Encode(company)
 }
@@ -239,6 +249,7 @@ func updateCompany(w http.ResponseWriter, r *http.Request) {
         http.Error(w, err.Error(), 500)
         return
     }
+    events.publish(r.Context(), companyUpdated, id, &company)
 
     json.NewEncoder(w).Encode(company)
 }
@@ -251,6 +262,7 @@ func deleteCompany(w http.ResponseWriter, r *http.Request) {
         http.Error(w, err.Error(), 500)
         return
     }
+    events.publish(r.Context(), companyDeleted, id, nil)
 
     json.NewEncoder(w).Encode(fmt.Sprintf("Company with ID %s deleted successfully", id))
 }